@@ -1,39 +1,67 @@
 package bot
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"hiurachat/internal/config"
 	"hiurachat/internal/connection"
 	"hiurachat/internal/handler"
 	"hiurachat/internal/logger"
 	"hiurachat/internal/types"
+	"sync"
 	"time"
 )
 
 type Bot struct {
-	client   *connection.Client
-	logger   *logger.Logger
-	handler  *handler.MessageHandler
-	commands map[string]types.Command
-	config   *config.Config
-	pingTime time.Time
+	client     *connection.Client
+	transport  connection.Transport
+	logger     *logger.Logger
+	handler    *handler.MessageHandler
+	commands   map[string]types.Command
+	config     *config.Config
+	wg         sync.WaitGroup
+	fatal      chan error
+	events     <-chan connection.StateEvent
+	identities <-chan connection.IdentityEvent
+	stopSubs   []func()
 }
 
 func New(logger *logger.Logger, cfg *config.Config) (*Bot, error) {
-	logger.Info("Initializing...")
-
 	client, err := connection.New(logger, cfg.WebSocket.URL, cfg.GetWebSocketConfig())
 	if err != nil {
 		return nil, err
 	}
 
+	return NewWithTransport(logger, cfg, client)
+}
+
+// NewWithTransport builds a bot on top of any Transport. Reconnect handling
+// and heartbeats are only set up when transport is a WebSocket client.
+func NewWithTransport(logger *logger.Logger, cfg *config.Config, transport connection.Transport) (*Bot, error) {
+	logger.Info("Initializing...")
+
 	bot := &Bot{
-		client:   client,
-		logger:   logger,
-		commands: make(map[string]types.Command),
-		config:   cfg,
+		transport: transport,
+		logger:    logger,
+		commands:  make(map[string]types.Command),
+		config:    cfg,
+		fatal:     make(chan error, 1),
+	}
+
+	if client, ok := transport.(*connection.Client); ok {
+		bot.client = client
+		if err := bot.setupGiveUp(cfg.WebSocket.Reconnect); err != nil {
+			return nil, err
+		}
 	}
 
-	handler := handler.New(logger, cfg.Bot.Prefix, cfg.Bot.ResponsePrefix, bot)
+	handler := handler.New(logger, cfg.Bot.Prefix, cfg.Bot.ResponsePrefix)
+	handler.SetAdmins(cfg.Bot.Admins)
+	if err := handler.SetThrottle(cfg.Bot.Throttle); err != nil {
+		return nil, err
+	}
+	handler.SetMessages(cfg.Bot.Messages)
 	bot.handler = handler
 
 	logger.Info("Loading commands")
@@ -43,23 +71,204 @@ func New(logger *logger.Logger, cfg *config.Config) (*Bot, error) {
 	return bot, nil
 }
 
-func (b *Bot) GetLatency() time.Time {
-	return b.pingTime
+// setupGiveUp decides what happens once the reconnect policy gives up:
+// either stop the bot so a supervisor can restart it, or keep retrying at a
+// slow fixed interval. Fatal closes always stop the bot, since retrying
+// would only be rejected again.
+func (b *Bot) setupGiveUp(cfg config.ReconnectConfig) error {
+	b.client.SetOnFatal(func(d connection.Disconnect) {
+		b.fail(fmt.Errorf("connection rejected: %s", d))
+	})
+
+	switch cfg.OnGiveUp {
+	case "exit":
+		b.client.SetOnGiveUp(func(attempts int, err error) {
+			b.fail(fmt.Errorf("gave up reconnecting after %d attempts: %w", attempts, err))
+		})
+	case "degraded":
+		b.client.SetOnGiveUp(func(attempts int, err error) {
+			b.logger.Warn("Reconnection failed %d times, retrying every %v", attempts, cfg.DegradedInterval)
+			b.client.ReconnectWith(connection.FixedBackoff{Delay: cfg.DegradedInterval})
+		})
+	default:
+		return fmt.Errorf("unknown on_give_up action %q", cfg.OnGiveUp)
+	}
+	return nil
+}
+
+func (b *Bot) requestID() *connection.Delivery {
+	return b.transport.SendWithPriority(types.Message{Action: "getId"}, connection.PriorityControl)
+}
+
+func (b *Bot) fail(err error) {
+	select {
+	case b.fatal <- err:
+	default:
+	}
 }
 
-func (b *Bot) SetLatency(t time.Time) {
-	b.pingTime = t
+// Run connects the bot and blocks until ctx is cancelled or the bot fails,
+// then shuts it down within the configured shutdown timeout.
+func (b *Bot) Run(ctx context.Context) error {
+	if err := b.Start(); err != nil {
+		return err
+	}
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+	case runErr = <-b.fatal:
+		b.logger.Error("Bot failed: %v", runErr)
+	}
+	b.logger.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), b.config.Bot.ShutdownTimeout)
+	defer cancel()
+
+	return errors.Join(runErr, b.Shutdown(shutdownCtx))
 }
 
 func (b *Bot) Start() error {
-	if err := b.client.Connect(); err != nil {
+	if err := b.transport.Connect(); err != nil {
 		return err
 	}
 
 	b.logger.Info("Loading events")
-	b.client.StartHeartbeat(time.Minute)
-	go b.handler.Listen(b.client)
-	b.client.RequestID()
+	if b.client != nil {
+		b.client.StartHeartbeat(time.Minute)
+	}
+
+	var stopEvents, stopIdentities func()
+	b.events, stopEvents = b.transport.Subscribe()
+	b.identities, stopIdentities = b.transport.SubscribeIdentity()
+	b.stopSubs = []func(){stopEvents, stopIdentities}
+
+	if interval := b.config.Bot.MetricsInterval; interval > 0 && b.client != nil {
+		stop := make(chan struct{})
+		b.stopSubs = append(b.stopSubs, func() { close(stop) })
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.logMetrics(interval, stop)
+		}()
+	}
+
+	b.wg.Add(3)
+	go func() {
+		defer b.wg.Done()
+		b.handler.Listen(b.transport)
+	}()
+	go func() {
+		defer b.wg.Done()
+		b.watchState()
+	}()
+	go func() {
+		defer b.wg.Done()
+		b.watchIdentity()
+	}()
+	b.requestID()
 
 	return nil
 }
+
+// Shutdown stops accepting commands, waits for in-flight commands to finish
+// and closes the connection. Commands still running when draining time is up
+// are abandoned, which is logged but not an error: the last quarter of ctx
+// is kept for the closing handshake.
+func (b *Bot) Shutdown(ctx context.Context) error {
+	b.handler.Stop()
+
+	drainCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		drainCtx, cancel = context.WithDeadline(ctx, deadline.Add(-time.Until(deadline)/4))
+		defer cancel()
+	}
+
+	var errs []error
+	if err := b.handler.Drain(drainCtx); err != nil {
+		b.logger.Warn("Abandoning commands still running at shutdown: %v", err)
+	}
+
+	if err := b.transport.Close(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close connection: %w", err))
+	}
+	for _, stop := range b.stopSubs {
+		stop()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("background tasks did not stop: %w", ctx.Err()))
+	}
+
+	return errors.Join(errs...)
+}
+
+// watchState logs connection transitions and announces when the bot is back
+// after an outage.
+func (b *Bot) watchState() {
+	reconnecting := false
+	for event := range b.events {
+		b.logger.Debug("Connection %s -> %s (%s)", event.From, event.To, event.Cause)
+
+		switch event.To {
+		case connection.StateReconnecting:
+			if !reconnecting {
+				b.logger.Warn("Connection lost: %s", event.Cause)
+			}
+			reconnecting = true
+		case connection.StateGaveUp:
+			b.logger.Error("Reconnection gave up: %s", event.Cause)
+		case connection.StateIdentified:
+			if !reconnecting {
+				continue
+			}
+			reconnecting = false
+			b.logger.Info("Back online")
+
+			if msg := b.config.Bot.ReconnectAnnouncement; msg != "" {
+				if err := b.handler.Announce(b.handler.GetResponsePrefix() + " " + msg); err != nil {
+					b.logger.Error("Failed to announce reconnect: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// logMetrics logs the connection statistics and every rate limit once per
+// interval until stop is closed.
+func (b *Bot) logMetrics(interval time.Duration, stop <-chan struct{}) {
+	ticker := b.client.Clock().NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+		}
+
+		b.logger.Info("Metrics: %s | %s | %s | %s", b.rttSummary(), b.inboxSummary(), b.endpointSummary(), b.rateSummary())
+		b.logger.Info("Metrics: %s", b.limitsSummary())
+	}
+}
+
+func (b *Bot) watchIdentity() {
+	for event := range b.identities {
+		if event.Old.ID == "" {
+			b.logger.Info("Connected as: %s (%s)", event.New.Name, event.New.ID)
+			continue
+		}
+
+		b.logger.Warn("Identity changed from %s (%s) to %s (%s)",
+			event.Old.Name, event.Old.ID, event.New.Name, event.New.ID)
+	}
+}
@@ -1,22 +1,22 @@
 package bot
 
 import (
+	"context"
 	"fmt"
 	"hiurachat/internal/types"
 	"strings"
 	"time"
 )
 
+const pingTimeout = 15 * time.Second
+
 func (b *Bot) initializeCommands() {
 	b.commands = map[string]types.Command{
 		"ping": {
 			Name:        "ping",
 			Description: "Check bot latency",
 			Execute: func(args []string) (string, bool) {
-				b.pingTime = time.Now()
-				if err := b.client.RequestID(); err != nil {
-					return fmt.Sprintf("%s Failed to ping", b.handler.GetResponsePrefix()), true
-				}
+				b.handler.Go(b.ping)
 				return "", false
 			},
 		},
@@ -30,6 +30,30 @@ func (b *Bot) initializeCommands() {
 				return "", false
 			},
 		},
+		"stats": {
+			Name:        "stats",
+			Description: "Show connection statistics",
+			Execute: func(args []string) (string, bool) {
+				return fmt.Sprintf("%s %s | %s | %s | %s", b.handler.GetResponsePrefix(),
+					b.rttSummary(), b.inboxSummary(), b.endpointSummary(), b.rateSummary()), true
+			},
+		},
+		"limits": {
+			Name:        "limits",
+			Description: "Show rate limiter state per route",
+			AdminOnly:   true,
+			Execute: func(args []string) (string, bool) {
+				return fmt.Sprintf("%s %s", b.handler.GetResponsePrefix(), b.limitsSummary()), true
+			},
+		},
+		"throttled": {
+			Name:        "throttled",
+			Description: "Show who has been throttled for sending commands too fast",
+			AdminOnly:   true,
+			Execute: func(args []string) (string, bool) {
+				return fmt.Sprintf("%s %s", b.handler.GetResponsePrefix(), b.throttleSummary()), true
+			},
+		},
 		"help": {
 			Name:        "Help",
 			Description: "Help",
@@ -40,11 +64,144 @@ func (b *Bot) initializeCommands() {
 	}
 }
 
+// ping awaits a getId round trip in the background so the listen loop keeps
+// handling other messages while the request is rate limited or in flight.
+func (b *Bot) ping() {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	start := time.Now()
+	reply := fmt.Sprintf("%s Failed to ping", b.handler.GetResponsePrefix())
+	if _, err := b.transport.Request(ctx, types.Message{Action: "getId"}); err != nil {
+		b.logger.Warn("Ping failed: %v", err)
+	} else {
+		reply = fmt.Sprintf("%s Pong! (Latency: %s)", b.handler.GetResponsePrefix(), ms(time.Since(start)))
+		if b.client != nil {
+			if rtt := b.client.RTT(); rtt.Samples > 0 {
+				reply += fmt.Sprintf(" (Heartbeat RTT p50: %s)", ms(rtt.P50))
+			}
+		}
+	}
+
+	if err := b.handler.SendMessage(reply); err != nil {
+		b.logger.Error("Failed to send ping response: %s", err)
+	}
+}
+
+func (b *Bot) rttSummary() string {
+	if b.client == nil {
+		return "RTT: not available on this transport"
+	}
+
+	rtt := b.client.RTT()
+	if rtt.Samples == 0 {
+		return "RTT: no heartbeat samples yet"
+	}
+
+	return fmt.Sprintf("RTT: last %s, min %s, avg %s, p50 %s, p99 %s (%d samples)",
+		ms(rtt.Last), ms(rtt.Min), ms(rtt.Avg), ms(rtt.P50), ms(rtt.P99), rtt.Samples)
+}
+
+func (b *Bot) inboxSummary() string {
+	if b.client == nil {
+		return "Inbound: not available on this transport"
+	}
+
+	in := b.client.InboxStats()
+	return fmt.Sprintf("Inbound (%s): %d buffered, %d dropped, %d spilled, %d on disk",
+		in.Policy, in.Buffered, in.Dropped, in.Spilled, in.OnDisk)
+}
+
+func (b *Bot) endpointSummary() string {
+	if b.client == nil {
+		return "Endpoints: not available on this transport"
+	}
+
+	var parts []string
+	for _, ep := range b.client.Endpoints() {
+		part := fmt.Sprintf("%s %.0f%%", ep.URL, ep.Score*100)
+		if ep.Current {
+			part = "*" + part
+		}
+		if ep.ConsecutiveFailures > 0 {
+			part += fmt.Sprintf(" (%d failing)", ep.ConsecutiveFailures)
+		}
+		parts = append(parts, part)
+	}
+	return "Endpoints: " + strings.Join(parts, ", ")
+}
+
+func (b *Bot) rateSummary() string {
+	if b.client == nil {
+		return "Rate: not available on this transport"
+	}
+
+	rate := b.client.RateLimitState()
+	if rate.Global.Limit == 0 {
+		return "Rate: unlimited"
+	}
+
+	summary := fmt.Sprintf("Rate: %.1f per %v, burst %d", rate.Global.Limit, rate.Global.Window, rate.Global.Burst)
+	if rate.Enabled {
+		summary += fmt.Sprintf(" (adaptive, %.0f%% of configured, %d decreases)", rate.Factor*100, rate.Decreases)
+	}
+	if limits := b.client.RateLimits(); len(limits) > 0 {
+		summary += fmt.Sprintf(", %d waits, %d denials", limits[0].Waits, limits[0].Denials)
+	}
+	return summary
+}
+
+func (b *Bot) limitsSummary() string {
+	if b.client == nil {
+		return "Limits: not available on this transport"
+	}
+
+	limits := b.client.RateLimits()
+	if len(limits) == 0 {
+		return "Limits: rate limiting is disabled"
+	}
+
+	var parts []string
+	for _, l := range limits {
+		route := l.Route
+		if route == "" {
+			route = "global"
+		}
+		part := fmt.Sprintf("%s %d/%d (%.1f per %v)", route, l.Remaining, l.Rate.Burst, l.Rate.Limit, l.Rate.Window)
+		if l.RetryAfter > 0 {
+			part += fmt.Sprintf(" next in %s", ms(l.RetryAfter))
+		}
+		part += fmt.Sprintf(", %d waits, %d denials", l.Waits, l.Denials)
+		parts = append(parts, part)
+	}
+	return "Limits: " + strings.Join(parts, " | ")
+}
+
+func (b *Bot) throttleSummary() string {
+	stats := b.handler.ThrottleStats()
+	if stats.Total == 0 {
+		return "Throttled: nobody yet"
+	}
+
+	var parts []string
+	for _, user := range stats.Top(5) {
+		parts = append(parts, fmt.Sprintf("%s %d", user, stats.Users[user]))
+	}
+	return fmt.Sprintf("Throttled: %d commands from %d users (%s)",
+		stats.Total, len(stats.Users), strings.Join(parts, ", "))
+}
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.2fms", float64(d.Microseconds())/1000.0)
+}
+
+// HandleCommand runs a command outside of chat. There is no sender to check,
+// so admin-only commands are refused.
 func (b *Bot) HandleCommand(commandStr string, args []string) (string, bool) {
 	commandName := strings.TrimPrefix(commandStr, b.handler.GetPrefix())
 
 	command, exists := b.commands[commandName]
-	if !exists {
+	if !exists || command.AdminOnly {
 		return "", false
 	}
 
@@ -0,0 +1,124 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fired reports whether ch has a tick waiting, and its time.
+func fired(ch <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-ch:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeTimer(t *testing.T) {
+	f := NewFake(epoch)
+	timer := f.NewTimer(time.Minute)
+
+	f.Advance(59 * time.Second)
+	if _, ok := fired(timer.C()); ok {
+		t.Fatal("timer fired early")
+	}
+
+	f.Advance(time.Second)
+	at, ok := fired(timer.C())
+	if !ok {
+		t.Fatal("timer did not fire after a minute")
+	}
+	if want := epoch.Add(time.Minute); !at.Equal(want) {
+		t.Errorf("timer fired at %v, want %v", at, want)
+	}
+	if f.Waiters() != 0 {
+		t.Errorf("%d waiters left after the timer fired", f.Waiters())
+	}
+
+	if timer.Reset(time.Second) {
+		t.Error("Reset reported a fired timer as active")
+	}
+	if !timer.Stop() {
+		t.Error("Stop reported a pending timer as inactive")
+	}
+	f.Advance(time.Hour)
+	if _, ok := fired(timer.C()); ok {
+		t.Error("stopped timer fired")
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(epoch)
+	ticker := f.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for i := 1; i <= 3; i++ {
+		f.Advance(30 * time.Second)
+		at, ok := fired(ticker.C())
+		if !ok {
+			t.Fatalf("no tick %d", i)
+		}
+		if want := epoch.Add(time.Duration(i) * 30 * time.Second); !at.Equal(want) {
+			t.Errorf("tick %d at %v, want %v", i, at, want)
+		}
+	}
+
+	// Like time.Ticker, ticks nobody received are dropped.
+	f.Advance(90 * time.Second)
+	if _, ok := fired(ticker.C()); !ok {
+		t.Fatal("no tick after 90s")
+	}
+	if _, ok := fired(ticker.C()); ok {
+		t.Error("missed ticks were queued")
+	}
+}
+
+func TestFakeAdvanceFiresInOrder(t *testing.T) {
+	f := NewFake(epoch)
+
+	order := make(chan time.Duration, 3)
+	for _, d := range []time.Duration{3 * time.Second, time.Second, 2 * time.Second} {
+		f.AfterFunc(d, func() { order <- d })
+	}
+
+	// AfterFunc runs fn in its own goroutine, so advance one second at a
+	// time and let each one report before the next can fire.
+	var got []time.Duration
+	for range 3 {
+		f.Advance(time.Second)
+		got = append(got, <-order)
+	}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("fired %v, want %v", got, want)
+		}
+	}
+	if !f.Now().Equal(epoch.Add(3 * time.Second)) {
+		t.Errorf("Now = %v after advancing 3s", f.Now())
+	}
+}
+
+func TestFakeAfterFuncStop(t *testing.T) {
+	f := NewFake(epoch)
+
+	called := make(chan struct{}, 1)
+	timer := f.AfterFunc(time.Minute, func() { called <- struct{}{} })
+	if timer.C() != nil {
+		t.Error("AfterFunc timer has a channel")
+	}
+	if !timer.Stop() {
+		t.Error("Stop reported a pending timer as inactive")
+	}
+
+	f.Advance(time.Hour)
+	select {
+	case <-called:
+		t.Error("stopped AfterFunc ran")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
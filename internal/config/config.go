@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"hiurachat/internal/clock"
 	"hiurachat/internal/ratelimit"
 	"os"
 	"path/filepath"
@@ -12,12 +13,42 @@ import (
 
 type Config struct {
 	Bot struct {
-		Prefix         string `yaml:"prefix"`
-		ResponsePrefix string `yaml:"response_prefix"`
+		Prefix                string         `yaml:"prefix"`
+		ResponsePrefix        string         `yaml:"response_prefix"`
+		ShutdownTimeout       time.Duration  `yaml:"shutdown_timeout"`
+		ReconnectAnnouncement string         `yaml:"reconnect_announcement"`
+		MetricsInterval       time.Duration  `yaml:"metrics_interval"`
+		Admins                []string       `yaml:"admins"`
+		Throttle              ThrottleConfig `yaml:"throttle"`
+		Messages              MessagesConfig `yaml:"messages"`
 	} `yaml:"bot"`
 
 	WebSocket struct {
-		URL string `yaml:"url"`
+		URL       string   `yaml:"url"`
+		Endpoints []string `yaml:"endpoints"`
+		Failover  struct {
+			Strategy      string        `yaml:"strategy"`
+			Cooldown      time.Duration `yaml:"cooldown"`
+			ProbeInterval time.Duration `yaml:"probe_interval"`
+		} `yaml:"failover"`
+		Queue struct {
+			MaxSize int           `yaml:"max_size"`
+			TTL     time.Duration `yaml:"ttl"`
+		} `yaml:"queue"`
+		Reconnect ReconnectConfig `yaml:"reconnect"`
+		Inbound   struct {
+			Buffer   int    `yaml:"buffer"`
+			Overflow string `yaml:"overflow"`
+			SpillDir string `yaml:"spill_dir"`
+		} `yaml:"inbound"`
+		RateLimit struct {
+			Enabled  *bool                     `yaml:"enabled"`
+			Global   ratelimit.Rate            `yaml:"global"`
+			Routes   map[string]ratelimit.Rate `yaml:"routes"`
+			Adaptive AdaptiveConfig            `yaml:"adaptive"`
+		} `yaml:"rate_limit"`
+		Record string       `yaml:"record"`
+		Dialer DialerConfig `yaml:",inline"`
 	} `yaml:"websocket"`
 
 	Logger struct {
@@ -26,27 +57,114 @@ type Config struct {
 	} `yaml:"logger"`
 }
 
-type WebSocketConfig struct {
-	URL                  string
-	MaxReconnectAttempts int
-	ReadTimeout          time.Duration
-	WriteTimeout         time.Duration
-	PingInterval         time.Duration
-	PingTimeout          time.Duration
-	HandshakeTimeout     time.Duration
-	MessageBufferSize    int
-	RateLimit            struct {
-		Enabled       bool
-		Global        GlobalRateLimit
-		WaitForTokens bool
-		RouteLimits   map[string]ratelimit.Rate
-	}
+// AdaptiveConfig turns on learning the server's real rate limit from its
+// throttling instead of trusting the configured rates.
+type AdaptiveConfig struct {
+	Enabled                  bool `yaml:"enabled"`
+	ratelimit.AdaptiveConfig `yaml:",inline"`
+}
+
+// ThrottleConfig limits how often each chat user may run commands. Admins
+// are never throttled.
+type ThrottleConfig struct {
+	// Key picks what identifies a user: "sender" (the connection ID) or
+	// "sender_name".
+	Key string `yaml:"key"`
+	// PerUser is the minimum time between any two commands from one user.
+	PerUser time.Duration `yaml:"per_user"`
+	// Commands sets a cooldown per command name, per user.
+	Commands map[string]time.Duration `yaml:"commands"`
+	// Notice is sent the first time a user is throttled, until they next
+	// get a command through. {name} and {wait} are replaced with the user's
+	// name and the time left. Empty sends nothing.
+	Notice string `yaml:"notice"`
+}
+
+// MessagesConfig shapes the chat messages the bot sends.
+type MessagesConfig struct {
+	// MaxLength splits longer messages, in characters. Zero never splits.
+	MaxLength int `yaml:"max_length"`
+	// Continuation ends every part of a split message but the last.
+	Continuation string `yaml:"continuation"`
+	// CoalesceWindow, when set, holds short replies for this long while the
+	// rate limiter is holding sends back and sends them as one message.
+	CoalesceWindow time.Duration `yaml:"coalesce_window"`
+}
+
+// ReconnectConfig picks the reconnect policy. MaxAttempts is how many
+// reconnects to try before giving up: unset means 10 and zero never gives up.
+type ReconnectConfig struct {
+	Policy           string        `yaml:"policy"`
+	BaseDelay        time.Duration `yaml:"base_delay"`
+	MaxDelay         time.Duration `yaml:"max_delay"`
+	MaxAttempts      *int          `yaml:"max_attempts"`
+	OnGiveUp         string        `yaml:"on_give_up"`
+	DegradedInterval time.Duration `yaml:"degraded_interval"`
+	NetworkBaseDelay time.Duration `yaml:"network_base_delay"`
+	NetworkMaxDelay  time.Duration `yaml:"network_max_delay"`
 }
 
-type GlobalRateLimit struct {
-	Messages int
-	Window   time.Duration
-	Burst    int
+// DialerConfig controls how the WebSocket connection is dialed. Its fields
+// sit directly under websocket: in the config file.
+type DialerConfig struct {
+	// Proxy is an http:// or socks5:// URL, "direct" to bypass any proxy,
+	// or empty to honour HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+	Proxy     string            `yaml:"proxy"`
+	Headers   map[string]string `yaml:"headers"`
+	AuthToken string            `yaml:"auth_token"`
+	Origin    string            `yaml:"origin"`
+	Cookies   map[string]string `yaml:"cookies"`
+	TLS       struct {
+		CAFile             string `yaml:"ca_file"`
+		CertFile           string `yaml:"cert_file"`
+		KeyFile            string `yaml:"key_file"`
+		ServerName         string `yaml:"server_name"`
+		InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	} `yaml:"tls"`
+}
+
+type WebSocketConfig struct {
+	URL       string
+	Endpoints []string
+	Failover  struct {
+		Strategy      string
+		Cooldown      time.Duration
+		ProbeInterval time.Duration
+	}
+	Reconnect        ReconnectConfig
+	Dialer           DialerConfig
+	Record           string
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	PingInterval     time.Duration
+	PingTimeout      time.Duration
+	HandshakeTimeout time.Duration
+	// RTTWindow is how many heartbeat round trips RTT stats cover. Zero
+	// means 100.
+	RTTWindow int
+	// Clock drives heartbeats, reconnect backoff, rate limiting, queue
+	// expiry and endpoint failover. Socket deadlines always use the system
+	// clock. Nil means the system clock.
+	Clock   clock.Clock
+	Inbound struct {
+		Buffer   int
+		Overflow string
+		SpillDir string
+	}
+	OutboundQueue struct {
+		MaxSize int
+		TTL     time.Duration
+	}
+	RateLimit struct {
+		Enabled     bool
+		Global      ratelimit.Rate
+		RouteLimits map[string]ratelimit.Rate
+		// TargetLimit, if set, limits sends to each types.Message.Target.
+		// The bot's own messages all go to the room and carry no target,
+		// so it only applies to callers that set one.
+		TargetLimit *ratelimit.Rate
+		Adaptive    *ratelimit.AdaptiveConfig
+	}
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -68,41 +186,152 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %v", err)
 	}
 
+	config.applyDefaults()
+
 	return &config, nil
 }
 
+func (c *Config) applyDefaults() {
+	if c.Bot.ShutdownTimeout <= 0 {
+		c.Bot.ShutdownTimeout = 10 * time.Second
+	}
+	if c.Bot.Throttle.Key == "" {
+		c.Bot.Throttle.Key = "sender"
+	}
+	if c.Bot.Messages.Continuation == "" {
+		c.Bot.Messages.Continuation = " …"
+	}
+
+	if len(c.WebSocket.Endpoints) == 0 && c.WebSocket.URL != "" {
+		c.WebSocket.Endpoints = []string{c.WebSocket.URL}
+	}
+
+	failover := &c.WebSocket.Failover
+	if failover.Strategy == "" {
+		failover.Strategy = "priority"
+	}
+	if failover.Cooldown <= 0 {
+		failover.Cooldown = 30 * time.Second
+	}
+	if failover.ProbeInterval <= 0 {
+		failover.ProbeInterval = time.Minute
+	}
+
+	if c.WebSocket.Queue.MaxSize <= 0 {
+		c.WebSocket.Queue.MaxSize = 100
+	}
+
+	if c.WebSocket.Queue.TTL <= 0 {
+		c.WebSocket.Queue.TTL = 2 * time.Minute
+	}
+
+	inbound := &c.WebSocket.Inbound
+	if inbound.Buffer <= 0 {
+		inbound.Buffer = 100
+	}
+	if inbound.Overflow == "" {
+		inbound.Overflow = "drop_newest"
+	}
+	if inbound.SpillDir == "" {
+		inbound.SpillDir = "spill"
+	}
+
+	rateLimit := &c.WebSocket.RateLimit
+	if rateLimit.Enabled == nil {
+		enabled := true
+		rateLimit.Enabled = &enabled
+	}
+	if rateLimit.Global.Limit <= 0 {
+		rateLimit.Global = ratelimit.Rate{Limit: 15, Window: 30 * time.Second, Burst: 3}
+	}
+	if rateLimit.Routes == nil {
+		rateLimit.Routes = map[string]ratelimit.Rate{
+			"getId": {Limit: 1, Window: 5 * time.Second, Burst: 1},
+		}
+	}
+
+	adaptive := &rateLimit.Adaptive
+	if adaptive.Decrease <= 0 || adaptive.Decrease >= 1 {
+		adaptive.Decrease = 0.5
+	}
+	if adaptive.MinFactor <= 0 || adaptive.MinFactor > 1 {
+		adaptive.MinFactor = 0.1
+	}
+	if adaptive.Increase <= 0 {
+		adaptive.Increase = 0.1
+	}
+	if adaptive.IncreaseInterval <= 0 {
+		adaptive.IncreaseInterval = time.Minute
+	}
+	if adaptive.BurstWindow <= 0 {
+		adaptive.BurstWindow = 10 * time.Second
+	}
+	if adaptive.BurstSends <= 0 {
+		adaptive.BurstSends = rateLimit.Global.Burst
+	}
+
+	reconnect := &c.WebSocket.Reconnect
+	if reconnect.Policy == "" {
+		reconnect.Policy = "exponential"
+	}
+	if reconnect.BaseDelay <= 0 {
+		reconnect.BaseDelay = time.Second
+	}
+	if reconnect.MaxDelay <= 0 {
+		reconnect.MaxDelay = time.Minute
+	}
+	if reconnect.MaxAttempts == nil {
+		attempts := 10
+		reconnect.MaxAttempts = &attempts
+	}
+	if reconnect.OnGiveUp == "" {
+		reconnect.OnGiveUp = "exit"
+	}
+	if reconnect.DegradedInterval <= 0 {
+		reconnect.DegradedInterval = 5 * time.Minute
+	}
+	if reconnect.NetworkBaseDelay <= 0 {
+		reconnect.NetworkBaseDelay = 5 * time.Second
+	}
+	if reconnect.NetworkMaxDelay <= 0 {
+		reconnect.NetworkMaxDelay = 5 * time.Minute
+	}
+}
+
 func (c *Config) GetWebSocketConfig() *WebSocketConfig {
 	cfg := &WebSocketConfig{
-		URL:                  c.WebSocket.URL,
-		MaxReconnectAttempts: 10,
-		ReadTimeout:          2 * time.Minute,
-		WriteTimeout:         10 * time.Second,
-		PingInterval:         30 * time.Second,
-		PingTimeout:          5 * time.Second,
-		HandshakeTimeout:     10 * time.Second,
-		MessageBufferSize:    100,
-	}
-
-	cfg.RateLimit.Enabled = true
-	cfg.RateLimit.Global = GlobalRateLimit{
-		Messages: 15,
-		Window:   30 * time.Second,
-		Burst:    3,
-	}
-
-	cfg.RateLimit.WaitForTokens = true
-
-	cfg.RateLimit.RouteLimits = map[string]ratelimit.Rate{
-		"default": {
-			Limit:  float64(cfg.RateLimit.Global.Messages),
-			Burst:  cfg.RateLimit.Global.Burst,
-			Window: cfg.RateLimit.Global.Window,
-		},
-		"getId": {
-			Limit:  1,
-			Burst:  1,
-			Window: 5 * time.Second,
-		},
+		URL:              c.WebSocket.URL,
+		Reconnect:        c.WebSocket.Reconnect,
+		Dialer:           c.WebSocket.Dialer,
+		Record:           c.WebSocket.Record,
+		ReadTimeout:      2 * time.Minute,
+		WriteTimeout:     10 * time.Second,
+		PingInterval:     30 * time.Second,
+		PingTimeout:      5 * time.Second,
+		HandshakeTimeout: 10 * time.Second,
+		RTTWindow:        100,
+	}
+
+	cfg.Endpoints = c.WebSocket.Endpoints
+	cfg.Failover.Strategy = c.WebSocket.Failover.Strategy
+	cfg.Failover.Cooldown = c.WebSocket.Failover.Cooldown
+	cfg.Failover.ProbeInterval = c.WebSocket.Failover.ProbeInterval
+
+	cfg.Inbound.Buffer = c.WebSocket.Inbound.Buffer
+	cfg.Inbound.Overflow = c.WebSocket.Inbound.Overflow
+	cfg.Inbound.SpillDir = c.WebSocket.Inbound.SpillDir
+
+	cfg.OutboundQueue.MaxSize = c.WebSocket.Queue.MaxSize
+	cfg.OutboundQueue.TTL = c.WebSocket.Queue.TTL
+
+	rateLimit := c.WebSocket.RateLimit
+	cfg.RateLimit.Enabled = rateLimit.Enabled == nil || *rateLimit.Enabled
+	cfg.RateLimit.Global = rateLimit.Global
+
+	// Every send passes the global bucket; these only add to it.
+	cfg.RateLimit.RouteLimits = rateLimit.Routes
+	if rateLimit.Adaptive.Enabled {
+		cfg.RateLimit.Adaptive = &rateLimit.Adaptive.AdaptiveConfig
 	}
 
 	return cfg
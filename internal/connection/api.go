@@ -1,8 +1,14 @@
 package connection
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hiurachat/internal/clock"
+	"hiurachat/internal/ratelimit"
 	"hiurachat/internal/types"
+	"net"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -12,45 +18,213 @@ func (c *Client) Listen(handler func(types.Response)) {
 		select {
 		case <-c.done:
 			return
-		case msg := <-c.messageChannel:
+		case msg := <-c.inbox.ch:
 			handler(msg)
 		}
 	}
 }
 
-func (c *Client) Close() error {
-	close(c.done)
-	if c.conn != nil {
-		err := c.conn.WriteMessage(
+// closeTimeout bounds the closing handshake once the caller's deadline has
+// passed, so a backlog that used up the deadline still ends in a normal
+// closure.
+const closeTimeout = time.Second
+
+// Close sends a normal closure frame, gives the server until ctx expires to
+// acknowledge it and then stops the heartbeat and monitor goroutines. If ctx
+// runs out before the writer gets to the close frame, whatever is still
+// queued is dropped and the frame is written directly.
+func (c *Client) Close(ctx context.Context) error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.close(ctx)
+	})
+	return err
+}
+
+func (c *Client) close(ctx context.Context) error {
+	prev := c.state.set(StateClosing, "close requested")
+	wasConnected := prev == StateConnected || prev == StateIdentified
+	sess := c.current()
+
+	if sess != nil && wasConnected {
+		c.awaitQueueDrained(ctx)
+
+		d := c.sendControl(
 			websocket.CloseMessage,
 			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
 		)
-		if err != nil {
-			c.logger.Error("Error sending close frame: %v", err)
+
+		select {
+		case <-d.Done():
+			if err := d.Err(); err != nil {
+				c.logger.Error("Error sending close frame: %v", err)
+			} else {
+				c.awaitCloseAck(ctx, sess)
+			}
+		case <-sess.done:
+			c.logger.Debug("Connection lost before the close frame was sent")
+		case <-ctx.Done():
+			c.closeNow(sess)
 		}
-		return c.conn.Close()
 	}
-	return nil
+
+	close(c.done)
+	c.queue.dropAll(fmt.Errorf("client closed"))
+	c.requests.failAll()
+
+	var err error
+	if sess != nil {
+		if err = sess.conn.Close(); errors.Is(err, net.ErrClosed) {
+			err = nil
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(stopped)
+	}()
+
+	if c.recorder != nil {
+		defer c.recorder.close()
+	}
+
+	// The goroutines stop as soon as the socket is closed, so give them a
+	// moment even when ctx has already run out.
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), closeTimeout)
+		defer cancel()
+	}
+
+	select {
+	case <-stopped:
+		c.inbox.close()
+		c.state.transition(StateClosed, "closed")
+		return err
+	case <-ctx.Done():
+		c.state.transition(StateClosed, "close timed out")
+		return ctx.Err()
+	}
 }
 
-func (c *Client) RequestID() error {
+// closeNow drops everything still queued and writes the close frame past the
+// writer, which may be held back by the rate limiter, then waits briefly for
+// the server's acknowledgement.
+func (c *Client) closeNow(sess *session) {
+	if n := c.queue.len(); n > 0 {
+		c.logger.Warn("Dropping %d queued messages to close the connection", n)
+	}
+	c.queue.dropAll(fmt.Errorf("client closed"))
+
+	err := sess.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(closeTimeout))
+	if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		c.logger.Error("Error sending close frame: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	c.awaitCloseAck(ctx, sess)
+}
+
+// awaitQueueDrained gives the writer a chance to flush queued messages
+// before the closing handshake starts.
+func (c *Client) awaitQueueDrained(ctx context.Context) {
+	c.poll(ctx, func() bool {
+		return c.queue.len() == 0 || !c.writable(c.current())
+	})
+}
+
+// awaitCloseAck waits for the monitor goroutine to read the server's closing
+// frame so the handshake completes before the socket is torn down.
+func (c *Client) awaitCloseAck(ctx context.Context, sess *session) {
+	select {
+	case <-sess.done:
+	case <-ctx.Done():
+	}
+}
+
+func (c *Client) poll(ctx context.Context, cond func() bool) {
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.clock.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// InboxStats reports how the inbound buffer has coped with bursts.
+func (c *Client) InboxStats() InboxStats {
+	return c.inbox.stats()
+}
+
+// Clock is the clock the client keeps time by.
+func (c *Client) Clock() clock.Clock {
+	return c.clock
+}
+
+func (c *Client) State() State {
+	return c.state.get()
+}
+
+// Subscribe returns a channel of state transitions and a function that
+// stops the subscription and closes the channel.
+func (c *Client) Subscribe() (<-chan StateEvent, func()) {
+	return c.state.subscribe(16)
+}
+
+// RequestID queues a getId on the control lane without waiting for it.
+func (c *Client) RequestID() *Delivery {
 	msg := types.Message{
 		Action: "getId",
 	}
-	return c.WriteJSON(msg)
+	return c.SendWithPriority(msg, PriorityControl)
+}
+
+// Identity is who the server last said we are.
+func (c *Client) Identity() Identity {
+	return c.identity.get()
 }
 
-func (c *Client) ReadJSON(v interface{}) error {
-	if c.conn == nil {
-		return fmt.Errorf("connection is nil")
+// SubscribeIdentity reports every change of identity, including the first
+// one after connecting.
+func (c *Client) SubscribeIdentity() (<-chan IdentityEvent, func()) {
+	return c.identity.events.subscribe(4)
+}
+
+// Endpoints reports the health of every configured endpoint, in priority
+// order.
+func (c *Client) Endpoints() []EndpointHealth {
+	return c.endpoints.health()
+}
+
+// RateLimitState reports the global send rate in force and what adaptive
+// rate limiting has learned. It is zero when rate limiting is disabled.
+func (c *Client) RateLimitState() ratelimit.AdaptiveState {
+	if c.rateLimiter == nil {
+		return ratelimit.AdaptiveState{}
 	}
-	return c.conn.ReadJSON(v)
+	return c.rateLimiter.Adaptive()
 }
 
-func (c *Client) GetBotID() string {
-	return c.botID
+// UnderPressure reports whether the rate limiter is holding sends back: the
+// global limit has no send left, or messages are already queued behind it.
+func (c *Client) UnderPressure() bool {
+	if c.rateLimiter == nil {
+		return false
+	}
+	return c.queue.len() > 0 || c.rateLimiter.Info("").Remaining == 0
 }
 
-func (c *Client) SetBotID(id string) {
-	c.botID = id
+// RateLimits returns a snapshot of the global and per-route send limits, or
+// nil when rate limiting is disabled.
+func (c *Client) RateLimits() []ratelimit.RateLimitInfo {
+	if c.rateLimiter == nil {
+		return nil
+	}
+	return c.rateLimiter.Snapshot()
 }
@@ -0,0 +1,49 @@
+package connection
+
+import "sync"
+
+// broadcaster fans values out to subscribers without ever blocking the
+// publisher: a subscriber that falls more than its buffer behind misses
+// values.
+type broadcaster[T any] struct {
+	mu          sync.Mutex
+	subscribers map[int]chan T
+	nextID      int
+}
+
+func (b *broadcaster[T]) publish(v T) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- v:
+		default:
+		}
+	}
+}
+
+func (b *broadcaster[T]) subscribe(buffer int) (<-chan T, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subscribers == nil {
+		b.subscribers = make(map[int]chan T)
+	}
+
+	id := b.nextID
+	b.nextID++
+	ch := make(chan T, buffer)
+	b.subscribers[id] = ch
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			delete(b.subscribers, id)
+			close(ch)
+		})
+	}
+}
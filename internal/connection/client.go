@@ -2,10 +2,11 @@ package connection
 
 import (
 	"fmt"
+	"hiurachat/internal/clock"
 	"hiurachat/internal/config"
 	"hiurachat/internal/logger"
 	"hiurachat/internal/ratelimit"
-	"hiurachat/internal/types"
+	"net/http"
 	"sync"
 	"time"
 
@@ -13,18 +14,32 @@ import (
 )
 
 type Client struct {
-	conn           *websocket.Conn
-	botID          string
-	logger         *logger.Logger
-	config         config.WebSocketConfig
-	writeMu        sync.Mutex
-	lastWrite      time.Time
-	isConnected    bool
-	done           chan struct{}
-	reconnecting   bool
-	messageChannel chan types.Response
-	rateLimiter    *ratelimit.RateLimiter
-	middleware     *ratelimit.RateLimitMiddleware
+	session         *session
+	identity        identityTracker
+	logger          *logger.Logger
+	config          config.WebSocketConfig
+	mu              sync.Mutex
+	lastWrite       time.Time
+	clock           clock.Clock
+	state           *stateMachine
+	done            chan struct{}
+	closeOnce       sync.Once
+	wg              sync.WaitGroup
+	inbox           *inbox
+	queue           *outboundQueue
+	requests        requestTracker
+	rtt             *rttWindow
+	rateLimiter     *ratelimit.RateLimiter
+	writerOnce      sync.Once
+	proberOnce      sync.Once
+	endpoints       *endpointPool
+	dialer          *websocket.Dialer
+	header          http.Header
+	recorder        *recorder
+	reconnectPolicy ReconnectPolicy
+	networkPolicy   ReconnectPolicy
+	onGiveUp        func(attempts int, err error)
+	onFatal         func(Disconnect)
 }
 
 func New(logger *logger.Logger, wsUrl string, cfg *config.WebSocketConfig) (*Client, error) {
@@ -32,36 +47,112 @@ func New(logger *logger.Logger, wsUrl string, cfg *config.WebSocketConfig) (*Cli
 		return nil, fmt.Errorf("logger is required")
 	}
 
-	if wsUrl == "" {
-		return nil, fmt.Errorf("websocket URL is required")
+	urls := cfg.Endpoints
+	if len(urls) == 0 && wsUrl != "" {
+		urls = []string{wsUrl}
+	}
+
+	clk := cfg.Clock
+	if clk == nil {
+		clk = clock.Real
+	}
+
+	endpoints, err := newEndpointPool(urls, cfg.Failover.Strategy, cfg.Failover.Cooldown, clk)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, header, err := newDialer(cfg.Dialer, cfg.HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := NewReconnectPolicy(cfg.Reconnect)
+	if err != nil {
+		return nil, err
 	}
 
 	var rateLimiter *ratelimit.RateLimiter
-	var middleware *ratelimit.RateLimitMiddleware
 
 	if cfg.RateLimit.Enabled {
-		rateLimiter := ratelimit.NewRateLimiter(ratelimit.Rate{
-			Limit:  float64(cfg.RateLimit.Global.Messages),
-			Window: cfg.RateLimit.Global.Window,
-			Burst:  cfg.RateLimit.Global.Burst,
-		}, cfg.RateLimit.WaitForTokens)
+		if err := validateRates(cfg); err != nil {
+			return nil, err
+		}
+		rateLimiter = ratelimit.NewRateLimiter(cfg.RateLimit.Global)
+		rateLimiter.SetClock(clk)
 
 		for route, rate := range cfg.RateLimit.RouteLimits {
 			rateLimiter.SetRouteLimit(route, rate)
 		}
+		if cfg.RateLimit.TargetLimit != nil {
+			rateLimiter.SetTargetLimit(*cfg.RateLimit.TargetLimit)
+		}
+		if cfg.RateLimit.Adaptive != nil {
+			rateLimiter.EnableAdaptive(*cfg.RateLimit.Adaptive, func(s ratelimit.AdaptiveState) {
+				logger.Info("Learned rate limit: %.1f per %v, burst %d (%.0f%% of configured)",
+					s.Global.Limit, s.Global.Window, s.Global.Burst, s.Factor*100)
+			})
+		}
+	}
 
-		middleware = ratelimit.NewMiddleware(rateLimiter)
+	done := make(chan struct{})
+	inbox, err := newInbox(logger, cfg.Inbound.Overflow, cfg.Inbound.Buffer, cfg.Inbound.SpillDir, done)
+	if err != nil {
+		return nil, err
 	}
 
 	client := &Client{
-		logger:         logger,
-		config:         *cfg,
-		lastWrite:      time.Now().Add(-1 * time.Second),
-		done:           make(chan struct{}),
-		messageChannel: make(chan types.Response, cfg.MessageBufferSize),
-		rateLimiter:    rateLimiter,
-		middleware:     middleware,
+		logger:          logger,
+		config:          *cfg,
+		lastWrite:       clk.Now().Add(-1 * time.Second),
+		clock:           clk,
+		state:           newStateMachine(clk),
+		identity:        identityTracker{clock: clk},
+		done:            done,
+		inbox:           inbox,
+		endpoints:       endpoints,
+		dialer:          dialer,
+		header:          header,
+		queue:           newOutboundQueue(cfg.OutboundQueue.MaxSize, clk),
+		rateLimiter:     rateLimiter,
+		reconnectPolicy: policy,
+		networkPolicy:   newNetworkPolicy(cfg.Reconnect),
+		rtt:             newRTTWindow(cfg.RTTWindow),
+	}
+
+	client.queue.discarded = client.discarded
+
+	if cfg.Record != "" {
+		if client.recorder, err = newRecorder(cfg.Record, clk); err != nil {
+			return nil, err
+		}
+		logger.Info("Recording frames to %s", cfg.Record)
+	}
+
+	if inbox.spill != nil {
+		client.wg.Add(1)
+		go func() {
+			defer client.wg.Done()
+			inbox.drainSpill()
+		}()
 	}
 
 	return client, nil
 }
+
+func validateRates(cfg *config.WebSocketConfig) error {
+	if err := cfg.RateLimit.Global.Validate(); err != nil {
+		return fmt.Errorf("global rate limit: %w", err)
+	}
+	for route, rate := range cfg.RateLimit.RouteLimits {
+		if err := rate.Validate(); err != nil {
+			return fmt.Errorf("rate limit for route %s: %w", route, err)
+		}
+	}
+	if cfg.RateLimit.TargetLimit != nil {
+		if err := cfg.RateLimit.TargetLimit.Validate(); err != nil {
+			return fmt.Errorf("per target rate limit: %w", err)
+		}
+	}
+	return nil
+}
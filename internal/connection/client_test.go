@@ -0,0 +1,405 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"hiurachat/internal/config"
+	"hiurachat/internal/logger"
+	"hiurachat/internal/mockserver"
+	"hiurachat/internal/ratelimit"
+	"hiurachat/internal/types"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func testLogger() *logger.Logger {
+	l := &logger.Logger{}
+	l.SetLogLevel(logger.ERROR + 1)
+	return l
+}
+
+func startServer(t *testing.T, opts mockserver.Options) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(mockserver.New(testLogger(), opts))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// startFlakyServer is startServer with a switch that makes every new
+// handshake fail with 503 while it is on.
+func startFlakyServer(t *testing.T, opts mockserver.Options) (*httptest.Server, *atomic.Bool) {
+	t.Helper()
+
+	var down atomic.Bool
+	mock := mockserver.New(testLogger(), opts)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &down
+}
+
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/?name=bot"
+}
+
+func testConfig(url string) *config.WebSocketConfig {
+	cfg := &config.WebSocketConfig{
+		URL: url,
+		Reconnect: config.ReconnectConfig{
+			Policy:           "fixed",
+			BaseDelay:        5 * time.Millisecond,
+			NetworkBaseDelay: 5 * time.Millisecond,
+			NetworkMaxDelay:  20 * time.Millisecond,
+		},
+		ReadTimeout:      5 * time.Second,
+		WriteTimeout:     time.Second,
+		PingInterval:     5 * time.Millisecond,
+		PingTimeout:      time.Second,
+		HandshakeTimeout: time.Second,
+	}
+	cfg.Inbound.Buffer = 16
+	cfg.Inbound.Overflow = OverflowDropOldest
+	cfg.OutboundQueue.MaxSize = 1000
+	cfg.OutboundQueue.TTL = 5 * time.Second
+	return cfg
+}
+
+func newTestClient(t *testing.T, cfg *config.WebSocketConfig) *Client {
+	t.Helper()
+
+	c, err := New(testLogger(), cfg.URL, cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		c.Close(ctx)
+	})
+	return c
+}
+
+// waitFor polls cond until it holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// countStates counts transitions into state until stop is called.
+func countStates(c *Client, state State) (count func() int, stop func()) {
+	events, unsubscribe := c.Subscribe()
+
+	var (
+		mu sync.Mutex
+		n  int
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for event := range events {
+			if event.To == state {
+				mu.Lock()
+				n++
+				mu.Unlock()
+			}
+		}
+	}()
+
+	count = func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return n
+	}
+	stop = func() {
+		unsubscribe()
+		<-done
+	}
+	return count, stop
+}
+
+func chat(message string) types.Message {
+	return types.Message{Action: "sendMessage", Data: &types.MessageData{Message: message}}
+}
+
+func TestConcurrentTrafficWhileServerDropsConnections(t *testing.T) {
+	srv := startServer(t, mockserver.Options{Faults: mockserver.Faults{DropAfter: 7}})
+
+	cfg := testConfig(wsURL(srv))
+	cfg.RateLimit.Enabled = true
+	cfg.RateLimit.Global = ratelimit.Rate{Limit: 1000, Window: time.Second, Burst: 50}
+	c := newTestClient(t, cfg)
+
+	reconnects, stopCounting := countStates(c, StateReconnecting)
+	defer stopCounting()
+
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	c.StartHeartbeat(5 * time.Millisecond)
+	go c.Listen(func(types.Response) {})
+
+	var (
+		wg         sync.WaitGroup
+		mu         sync.Mutex
+		deliveries []*Delivery
+	)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 25 {
+				d := c.Send(chat("hello"))
+				mu.Lock()
+				deliveries = append(deliveries, d)
+				mu.Unlock()
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				// Requests may fail when the connection drops under them.
+				c.Request(ctx, types.Message{Action: "getId"})
+				cancel()
+				c.State()
+				c.Identity()
+				c.RTT()
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitFor(t, "every send to be resolved", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, d := range deliveries {
+			if d.Status() == Pending {
+				return false
+			}
+		}
+		return true
+	})
+
+	var delivered int
+	for _, d := range deliveries {
+		if d.Status() == Delivered {
+			delivered++
+		}
+	}
+	if delivered == 0 {
+		t.Error("no send was delivered")
+	}
+	if reconnects() == 0 {
+		t.Error("the server never dropped the connection")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := c.State(); got != StateClosed {
+		t.Fatalf("state after Close = %s, want closed", got)
+	}
+}
+
+func TestCloseDuringReconnect(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay time.Duration
+	}{
+		// The client sleeps out a long backoff when Close arrives.
+		{"waiting", time.Hour},
+		// The client keeps dialing a server that is gone.
+		{"dialing", time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The server cuts the connection on the frame after getId.
+			srv, down := startFlakyServer(t, mockserver.Options{Faults: mockserver.Faults{DropAfter: 2}})
+
+			cfg := testConfig(wsURL(srv))
+			cfg.Reconnect.BaseDelay = tt.delay
+			cfg.Reconnect.NetworkBaseDelay = tt.delay
+			cfg.Reconnect.NetworkMaxDelay = tt.delay
+			c := newTestClient(t, cfg)
+
+			if err := c.Connect(); err != nil {
+				t.Fatalf("Connect: %v", err)
+			}
+			go c.Listen(func(types.Response) {})
+			c.RequestID()
+			waitFor(t, "the client to identify", func() bool { return c.State() == StateIdentified })
+
+			down.Store(true)
+			c.Send(chat("dropped by the server"))
+			waitFor(t, "the client to reconnect", func() bool { return c.State() == StateReconnecting })
+
+			sent := c.Send(chat("never delivered"))
+			time.Sleep(10 * time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := c.Close(ctx); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if got := c.State(); got != StateClosed {
+				t.Fatalf("state after Close = %s, want closed", got)
+			}
+			if err := sent.Wait(ctx); err == nil || errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("queued send resolved with %v, want it dropped", err)
+			}
+		})
+	}
+}
+
+func TestRateLimitCountsWaitsAndDenials(t *testing.T) {
+	srv := startServer(t, mockserver.Options{})
+
+	cfg := testConfig(wsURL(srv))
+	cfg.RateLimit.Enabled = true
+	cfg.RateLimit.Global = ratelimit.Rate{Limit: 1, Window: 50 * time.Millisecond, Burst: 1}
+	c := newTestClient(t, cfg)
+
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	go c.Listen(func(types.Response) {})
+
+	var deliveries []*Delivery
+	for range 4 {
+		deliveries = append(deliveries, c.Send(chat("hello")))
+	}
+	for _, d := range deliveries {
+		if err := d.Wait(context.Background()); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+
+	// The last send emptied the bucket, so this one is held back until it
+	// is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := c.SendContext(ctx, chat("cancelled"), PriorityInteractive)
+	waitFor(t, "the send to be held back", func() bool {
+		c.queue.mu.Lock()
+		defer c.queue.mu.Unlock()
+		lane := c.queue.lanes[PriorityInteractive]
+		return len(lane) == 1 && lane[0].held
+	})
+	cancel()
+	if err := cancelled.Wait(context.Background()); err == nil {
+		t.Fatal("cancelled send was delivered")
+	}
+
+	global := c.RateLimits()[0]
+	if global.Waits != 3 || global.Denials != 1 {
+		t.Fatalf("waits = %d, denials = %d, want 3 and 1", global.Waits, global.Denials)
+	}
+}
+
+func TestCloseSendsNormalClosurePastBacklog(t *testing.T) {
+	codes := make(chan int, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) {
+					codes <- closeErr.Code
+				} else {
+					codes <- websocket.CloseAbnormalClosure
+				}
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := testConfig(wsURL(srv))
+	cfg.RateLimit.Enabled = true
+	cfg.RateLimit.Global = ratelimit.Rate{Limit: 1, Window: 10 * time.Second, Burst: 1}
+	c := newTestClient(t, cfg)
+
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	var deliveries []*Delivery
+	for range 3 {
+		deliveries = append(deliveries, c.Send(chat("hello")))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	select {
+	case code := <-codes:
+		if code != websocket.CloseNormalClosure {
+			t.Errorf("server saw close code %d, want %d", code, websocket.CloseNormalClosure)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the server never saw the connection close")
+	}
+	if err := deliveries[2].Wait(context.Background()); err == nil {
+		t.Error("a send still held back at close was delivered")
+	}
+}
+
+func TestAbandonedRequestsLeaveTheQueue(t *testing.T) {
+	srv := startServer(t, mockserver.Options{})
+
+	cfg := testConfig(wsURL(srv))
+	cfg.RateLimit.Enabled = true
+	cfg.RateLimit.Global = ratelimit.Rate{Limit: 1, Window: time.Hour, Burst: 1}
+	c := newTestClient(t, cfg)
+
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	go c.Listen(func(types.Response) {})
+	if err := c.Send(chat("uses the only token")).Wait(context.Background()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	for range 5 {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		if _, err := c.Request(ctx, types.Message{Action: "getId"}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Request = %v, want the deadline to pass", err)
+		}
+		cancel()
+	}
+
+	waitFor(t, "the abandoned requests to leave the queue", func() bool { return c.queue.len() == 0 })
+}
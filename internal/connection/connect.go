@@ -1,28 +1,135 @@
 package connection
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Connect dials the endpoints in the order the failover strategy picks them
+// and returns the last error if none of them answers.
 func (c *Client) Connect() error {
-	dialer := websocket.DefaultDialer
-	dialer.HandshakeTimeout = c.config.HandshakeTimeout
-	dialer.EnableCompression = true
+	prev := c.state.get()
+	if !c.state.transition(StateConnecting, "dialing", StateIdle, StateReconnecting) {
+		return fmt.Errorf("cannot connect while %s", prev)
+	}
 
-	conn, _, err := dialer.Dial(c.config.URL, nil)
+	var (
+		ep   *endpoint
+		conn *websocket.Conn
+		err  error
+	)
+	for range c.endpoints.endpoints {
+		ep = c.endpoints.pick()
+		if conn, err = c.dial(ep); err == nil {
+			break
+		}
+		if len(c.endpoints.endpoints) > 1 {
+			c.logger.Warn("Endpoint unavailable, trying the next one: %v", err)
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("failed to establish connection: %w", err)
+		c.state.transition(prev, err.Error(), StateConnecting)
+		return err
 	}
 
 	conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
 	conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
 
-	c.conn = conn
-	c.isConnected = true
-	go c.monitorConnection()
+	sess := newSession(conn, ep)
+	c.swapSession(sess)
+	if !c.state.transition(StateConnected, "connected to "+ep.url, StateConnecting) {
+		conn.Close()
+		close(sess.done)
+		return fmt.Errorf("connection abandoned while %s", c.state.get())
+	}
+
+	c.wg.Add(1)
+	go c.monitorConnection(sess)
+
+	c.writerOnce.Do(func() {
+		c.wg.Add(1)
+		go c.writeLoop()
+	})
+	c.proberOnce.Do(func() {
+		if c.endpoints.strategy == StrategyPriority && len(c.endpoints.endpoints) > 1 {
+			c.wg.Add(1)
+			go c.probePreferred()
+		}
+	})
+	c.queue.signal()
 
 	return nil
 }
+
+// dial opens a socket to ep and records the outcome in its health score.
+func (c *Client) dial(ep *endpoint) (*websocket.Conn, error) {
+	conn, resp, err := c.dialer.Dial(ep.url, c.header)
+	c.endpoints.record(ep, err == nil)
+	if err != nil {
+		if errors.Is(err, websocket.ErrBadHandshake) && resp != nil {
+			err = &handshakeError{status: resp.StatusCode, retryAfter: resp.Header.Get("Retry-After"), err: err}
+		}
+		return nil, fmt.Errorf("failed to establish connection to %s: %w", ep.url, err)
+	}
+	return conn, nil
+}
+
+// probePreferred periodically dials the endpoints ranked above the one in
+// use and fails back to the first that answers.
+func (c *Client) probePreferred() {
+	defer c.wg.Done()
+
+	ticker := c.clock.NewTicker(c.config.Failover.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C():
+		}
+
+		if !c.state.is(StateIdentified) {
+			continue
+		}
+
+		for _, ep := range c.endpoints.preferred() {
+			conn, err := c.dial(ep)
+			if err != nil {
+				c.logger.Debug("Preferred endpoint still down: %v", err)
+				continue
+			}
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "probe"),
+				time.Now().Add(c.config.WriteTimeout))
+			conn.Close()
+
+			c.failBack(ep)
+			break
+		}
+	}
+}
+
+// failBack leaves the current endpoint for ep, which the next Connect picks
+// because it now has a fresh success on record.
+func (c *Client) failBack(ep *endpoint) {
+	sess := c.current()
+	if sess == nil || !c.state.transition(StateReconnecting, "failing back to "+ep.url, StateIdentified) {
+		return
+	}
+
+	c.logger.Info("Endpoint %s has recovered, failing back from %s", ep.url, sess.endpoint.url)
+	sess.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, "failing back"),
+		time.Now().Add(c.config.WriteTimeout))
+
+	c.requests.failAll()
+	c.queue.setPaused(true)
+	c.startReconnect(c.reconnectPolicy, Disconnect{
+		Category: DisconnectNormal,
+		Err:      fmt.Errorf("failing back to %s", ep.url),
+	})
+}
@@ -0,0 +1,103 @@
+package connection
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"hiurachat/internal/config"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newDialer builds the dialer and handshake headers a client uses for every
+// connection, so nothing is shared with websocket.DefaultDialer.
+func newDialer(cfg config.DialerConfig, handshakeTimeout time.Duration) (*websocket.Dialer, http.Header, error) {
+	dialer := &websocket.Dialer{
+		HandshakeTimeout:  handshakeTimeout,
+		EnableCompression: true,
+	}
+
+	switch cfg.Proxy {
+	case "":
+		dialer.Proxy = http.ProxyFromEnvironment
+	case "direct":
+	default:
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		if proxyURL.Scheme != "http" && proxyURL.Scheme != "socks5" {
+			return nil, nil, fmt.Errorf("unsupported proxy scheme %q, want http or socks5", proxyURL.Scheme)
+		}
+		dialer.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	dialer.TLSClientConfig = tlsConfig
+
+	header := http.Header{}
+	for name, value := range cfg.Headers {
+		header.Set(name, value)
+	}
+	if cfg.AuthToken != "" {
+		header.Set("Authorization", "Bearer "+cfg.AuthToken)
+	}
+	if cfg.Origin != "" {
+		header.Set("Origin", cfg.Origin)
+	}
+	if len(cfg.Cookies) > 0 {
+		cookies := make([]string, 0, len(cfg.Cookies))
+		for _, name := range slices.Sorted(maps.Keys(cfg.Cookies)) {
+			cookies = append(cookies, (&http.Cookie{Name: name, Value: cfg.Cookies[name]}).String())
+		}
+		header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+
+	return dialer, header, nil
+}
+
+// newTLSConfig returns nil when no TLS option is set, leaving the dialer on
+// the system defaults.
+func newTLSConfig(cfg config.DialerConfig) (*tls.Config, error) {
+	t := cfg.TLS
+	if t.CAFile == "" && t.CertFile == "" && t.KeyFile == "" && t.ServerName == "" && !t.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", t.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
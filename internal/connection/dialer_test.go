@@ -0,0 +1,256 @@
+package connection
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"hiurachat/internal/config"
+	"hiurachat/internal/mockserver"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dial opens and closes a connection to url with a dialer built from cfg.
+func dial(t *testing.T, cfg config.DialerConfig, url string) error {
+	t.Helper()
+
+	dialer, header, err := newDialer(cfg, time.Second)
+	if err != nil {
+		t.Fatalf("newDialer: %v", err)
+	}
+	conn, _, err := dialer.Dial(url, header)
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
+func wssURL(srv *httptest.Server) string {
+	return "wss" + strings.TrimPrefix(srv.URL, "https") + "/"
+}
+
+// writePEM writes one PEM block to a file in dir and returns its path.
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// clientCert creates a self-signed client certificate and returns it with
+// the paths of its certificate and key files.
+func clientCert(t *testing.T) (*x509.Certificate, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "hiurachat test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	return cert, writePEM(t, dir, "client.pem", "CERTIFICATE", der), writePEM(t, dir, "client.key", "EC PRIVATE KEY", keyDER)
+}
+
+func TestDialerTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(mockserver.New(testLogger(), mockserver.Options{}))
+	defer srv.Close()
+
+	caFile := writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+
+	if err := dial(t, config.DialerConfig{}, wssURL(srv)); err == nil {
+		t.Error("dialed a server with an untrusted certificate")
+	}
+
+	var cfg config.DialerConfig
+	cfg.TLS.CAFile = caFile
+	if err := dial(t, cfg, wssURL(srv)); err != nil {
+		t.Errorf("dial with ca_file: %v", err)
+	}
+
+	cfg = config.DialerConfig{}
+	cfg.TLS.InsecureSkipVerify = true
+	if err := dial(t, cfg, wssURL(srv)); err != nil {
+		t.Errorf("dial with insecure_skip_verify: %v", err)
+	}
+}
+
+func TestDialerClientCertificate(t *testing.T) {
+	cert, certFile, keyFile := clientCert(t)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+
+	srv := httptest.NewUnstartedServer(mockserver.New(testLogger(), mockserver.Options{}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+
+	var cfg config.DialerConfig
+	cfg.TLS.CAFile = writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	if err := dial(t, cfg, wssURL(srv)); err == nil {
+		t.Error("dialed a server requiring a client certificate without one")
+	}
+
+	cfg.TLS.CertFile, cfg.TLS.KeyFile = certFile, keyFile
+	if err := dial(t, cfg, wssURL(srv)); err != nil {
+		t.Errorf("dial with client certificate: %v", err)
+	}
+}
+
+func TestDialerAuthToken(t *testing.T) {
+	srv := startServer(t, mockserver.Options{Token: "secret"})
+
+	if err := dial(t, config.DialerConfig{}, wsURL(srv)); err == nil {
+		t.Error("dialed a server requiring a token without one")
+	}
+	if err := dial(t, config.DialerConfig{AuthToken: "wrong"}, wsURL(srv)); err == nil {
+		t.Error("dialed a server requiring a token with the wrong one")
+	}
+	if err := dial(t, config.DialerConfig{AuthToken: "secret"}, wsURL(srv)); err != nil {
+		t.Errorf("dial with auth_token: %v", err)
+	}
+}
+
+func TestDialerHeaders(t *testing.T) {
+	var got atomic.Pointer[http.Header]
+	mock := mockserver.New(testLogger(), mockserver.Options{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Clone()
+		got.Store(&header)
+		mock.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	cfg := config.DialerConfig{
+		Headers: map[string]string{"X-Bot-Version": "1.0"},
+		Origin:  srv.URL,
+		Cookies: map[string]string{"session": "abc123", "lang": "en"},
+	}
+	if err := dial(t, cfg, wsURL(srv)); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	header := *got.Load()
+	want := map[string]string{
+		"X-Bot-Version": "1.0",
+		"Origin":        srv.URL,
+		"Cookie":        "lang=en; session=abc123",
+	}
+	for name, value := range want {
+		if header.Get(name) != value {
+			t.Errorf("%s = %q, want %q", name, header.Get(name), value)
+		}
+	}
+}
+
+// connectProxy is an HTTP proxy that only tunnels CONNECT requests and
+// counts them.
+type connectProxy struct {
+	tunnels atomic.Int32
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	p.tunnels.Add(1)
+
+	go io.Copy(upstream, buf)
+	io.Copy(conn, upstream)
+}
+
+func TestDialerHTTPProxy(t *testing.T) {
+	srv := startServer(t, mockserver.Options{})
+
+	proxy := &connectProxy{}
+	proxySrv := httptest.NewServer(proxy)
+	defer proxySrv.Close()
+
+	if err := dial(t, config.DialerConfig{Proxy: proxySrv.URL}, wsURL(srv)); err != nil {
+		t.Fatalf("dial through proxy: %v", err)
+	}
+	if proxy.tunnels.Load() != 1 {
+		t.Errorf("proxy tunnelled %d connections, want 1", proxy.tunnels.Load())
+	}
+
+	if err := dial(t, config.DialerConfig{Proxy: "direct"}, wsURL(srv)); err != nil {
+		t.Fatalf("direct dial: %v", err)
+	}
+	if proxy.tunnels.Load() != 1 {
+		t.Error("direct dial went through the proxy")
+	}
+}
+
+func TestNewDialerRejectsBadOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  func(*config.DialerConfig)
+	}{
+		{"proxy scheme", func(c *config.DialerConfig) { c.Proxy = "ftp://proxy:21" }},
+		{"missing CA bundle", func(c *config.DialerConfig) { c.TLS.CAFile = filepath.Join(t.TempDir(), "missing.pem") }},
+		{"key without certificate", func(c *config.DialerConfig) { c.TLS.KeyFile = "client.key" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config.DialerConfig
+			tt.cfg(&cfg)
+			if _, _, err := newDialer(cfg, time.Second); err == nil {
+				t.Error("newDialer accepted the options")
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package connection
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DisconnectCategory says how the client reacts to a lost or refused
+// connection.
+type DisconnectCategory int
+
+const (
+	// DisconnectTransient covers abnormal closures, timeouts and refused
+	// dials; the reconnect policy decides the delay.
+	DisconnectTransient DisconnectCategory = iota
+	// DisconnectNormal is a clean close or the server going away; the
+	// client reconnects immediately.
+	DisconnectNormal
+	// DisconnectTryLater is the server asking for a pause; its delay is
+	// honoured when it provides one.
+	DisconnectTryLater
+	// DisconnectNetwork is a DNS or TLS failure, which follows its own
+	// backoff track because it rarely fixes itself quickly.
+	DisconnectNetwork
+	// DisconnectFatal is a policy violation or rejected credentials; the
+	// client stops reconnecting.
+	DisconnectFatal
+)
+
+func (c DisconnectCategory) String() string {
+	switch c {
+	case DisconnectTransient:
+		return "transient"
+	case DisconnectNormal:
+		return "normal"
+	case DisconnectTryLater:
+		return "try again later"
+	case DisconnectNetwork:
+		return "network"
+	case DisconnectFatal:
+		return "fatal"
+	}
+	return fmt.Sprintf("DisconnectCategory(%d)", int(c))
+}
+
+// Close codes without a constant in gorilla/websocket. 3000 and 3003 are the
+// IANA-registered unauthorized and forbidden codes; 4001 and 4003 are their
+// common application-range spellings.
+const (
+	closeUnauthorized    = 3000
+	closeForbidden       = 3003
+	closeAppUnauthorized = 4001
+	closeAppForbidden    = 4003
+)
+
+// Disconnect describes why a connection ended or could not be established.
+type Disconnect struct {
+	Category DisconnectCategory
+	// Code is the WebSocket close code, or the HTTP status of a rejected
+	// handshake. It is zero when neither applies.
+	Code   int
+	Reason string
+	// RetryAfter is the delay the server asked for, if any.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (d Disconnect) String() string {
+	// Err already carries the close code and reason, or the HTTP status.
+	s := d.Category.String()
+	if d.RetryAfter > 0 {
+		s += fmt.Sprintf(", retry after %v", d.RetryAfter)
+	}
+	return s + ": " + d.Err.Error()
+}
+
+// handshakeError keeps the HTTP response of a rejected WebSocket upgrade so
+// the status code can be classified.
+type handshakeError struct {
+	status     int
+	retryAfter string
+	err        error
+}
+
+func (e *handshakeError) Error() string {
+	return fmt.Sprintf("%v (HTTP %d %s)", e.err, e.status, http.StatusText(e.status))
+}
+
+func (e *handshakeError) Unwrap() error { return e.err }
+
+func classifyDisconnect(err error) Disconnect {
+	d := Disconnect{Category: DisconnectTransient, Err: err}
+
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		d.Code = closeErr.Code
+		d.Reason = closeErr.Text
+
+		switch closeErr.Code {
+		case websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseServiceRestart:
+			d.Category = DisconnectNormal
+		case websocket.CloseTryAgainLater:
+			d.Category = DisconnectTryLater
+			d.RetryAfter = parseRetryAfter(closeErr.Text)
+		case websocket.ClosePolicyViolation, closeUnauthorized, closeForbidden,
+			closeAppUnauthorized, closeAppForbidden:
+			d.Category = DisconnectFatal
+		}
+		return d
+	}
+
+	var hsErr *handshakeError
+	if errors.As(err, &hsErr) {
+		d.Code = hsErr.status
+
+		switch hsErr.status {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			d.Category = DisconnectFatal
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			d.Category = DisconnectTryLater
+			d.RetryAfter = parseRetryAfter(hsErr.retryAfter)
+		}
+		return d
+	}
+
+	if isNetworkError(err) {
+		d.Category = DisconnectNetwork
+	}
+	return d
+}
+
+func isNetworkError(err error) bool {
+	var (
+		dnsErr       *net.DNSError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+
+	return errors.As(err, &dnsErr) ||
+		errors.As(err, &recordErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+var retryAfterPattern = regexp.MustCompile(`(?:\d+(?:\.\d+)?(?:ns|us|µs|ms|s|m|h))+|\d+(?:\.\d+)?`)
+
+// parseRetryAfter finds the first duration in s. It accepts Go durations
+// ("retry after 1m30s") and bare numbers of seconds, as in an HTTP
+// Retry-After header.
+func parseRetryAfter(s string) time.Duration {
+	match := retryAfterPattern.FindString(s)
+	if match == "" {
+		return 0
+	}
+
+	if d, err := time.ParseDuration(match); err == nil {
+		return max(d, 0)
+	}
+	if secs, err := strconv.ParseFloat(match, 64); err == nil {
+		return time.Duration(secs * float64(time.Second))
+	}
+	return 0
+}
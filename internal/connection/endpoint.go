@@ -0,0 +1,192 @@
+package connection
+
+import (
+	"fmt"
+	"hiurachat/internal/clock"
+	"sync"
+	"time"
+)
+
+const (
+	StrategyPriority   = "priority"
+	StrategyRoundRobin = "round_robin"
+)
+
+// healthWindow is how many recent connect attempts an endpoint is scored on.
+const healthWindow = 10
+
+// EndpointHealth is a snapshot of how an endpoint has behaved recently.
+type EndpointHealth struct {
+	URL string
+	// Score is the share of recent connect attempts that succeeded, from 0
+	// to 1. Endpoints that were never tried score 1.
+	Score               float64
+	Attempts            int
+	ConsecutiveFailures int
+	LastFailure         time.Time
+	Current             bool
+}
+
+type endpoint struct {
+	url      string
+	priority int
+
+	results     [healthWindow]bool
+	recorded    int
+	next        int
+	failures    int
+	lastFailure time.Time
+}
+
+func (e *endpoint) record(ok bool, now time.Time) {
+	e.results[e.next] = ok
+	e.next = (e.next + 1) % healthWindow
+	e.recorded = min(e.recorded+1, healthWindow)
+
+	if ok {
+		e.failures = 0
+		return
+	}
+	e.failures++
+	e.lastFailure = now
+}
+
+func (e *endpoint) score() float64 {
+	if e.recorded == 0 {
+		return 1
+	}
+
+	var ok int
+	for i := range e.recorded {
+		if e.results[i] {
+			ok++
+		}
+	}
+	return float64(ok) / float64(e.recorded)
+}
+
+// available reports whether e may be picked again: it has not failed lately,
+// or its cooldown, which grows with consecutive failures, has passed.
+func (e *endpoint) available(now time.Time, cooldown time.Duration) bool {
+	if e.failures == 0 {
+		return true
+	}
+	return now.Sub(e.lastFailure) >= cooldown*time.Duration(min(e.failures, healthWindow))
+}
+
+// endpointPool picks which endpoint to dial next and keeps each endpoint's
+// health score.
+type endpointPool struct {
+	mu        sync.Mutex
+	endpoints []*endpoint
+	strategy  string
+	cooldown  time.Duration
+	current   *endpoint
+	cursor    int
+	clock     clock.Clock
+}
+
+func newEndpointPool(urls []string, strategy string, cooldown time.Duration, clk clock.Clock) (*endpointPool, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("websocket URL is required")
+	}
+
+	switch strategy {
+	case "":
+		strategy = StrategyPriority
+	case StrategyPriority, StrategyRoundRobin:
+	default:
+		return nil, fmt.Errorf("unknown failover strategy %q", strategy)
+	}
+
+	p := &endpointPool{strategy: strategy, cooldown: cooldown, clock: clk}
+	for i, url := range urls {
+		if url == "" {
+			return nil, fmt.Errorf("endpoint %d has no URL", i+1)
+		}
+		p.endpoints = append(p.endpoints, &endpoint{url: url, priority: i})
+	}
+	return p, nil
+}
+
+// pick chooses the endpoint for the next connect attempt. Priority takes the
+// first available endpoint in list order; round-robin takes the next
+// available one after the last pick. When every endpoint is cooling down the
+// best-scoring one is used, so an outage never stops the client dialing.
+func (p *endpointPool) pick() *endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	n := len(p.endpoints)
+
+	start := 0
+	if p.strategy == StrategyRoundRobin {
+		start = p.cursor
+	}
+
+	for i := range n {
+		e := p.endpoints[(start+i)%n]
+		if e.available(now, p.cooldown) {
+			p.cursor = (e.priority + 1) % n
+			return e
+		}
+	}
+
+	best := p.endpoints[0]
+	for _, e := range p.endpoints[1:] {
+		if e.score() > best.score() {
+			best = e
+		}
+	}
+	p.cursor = (best.priority + 1) % n
+	return best
+}
+
+func (p *endpointPool) record(e *endpoint, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e.record(ok, p.clock.Now())
+	if ok {
+		p.current = e
+	}
+}
+
+// preferred returns the available endpoints ranked above the one in use,
+// best first. It is empty unless the pool uses the priority strategy.
+func (p *endpointPool) preferred() []*endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.strategy != StrategyPriority || p.current == nil {
+		return nil
+	}
+
+	now := p.clock.Now()
+	var better []*endpoint
+	for _, e := range p.endpoints[:p.current.priority] {
+		if e.available(now, p.cooldown) {
+			better = append(better, e)
+		}
+	}
+	return better
+}
+
+func (p *endpointPool) health() []EndpointHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make([]EndpointHealth, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		out = append(out, EndpointHealth{
+			URL:                 e.url,
+			Score:               e.score(),
+			Attempts:            e.recorded,
+			ConsecutiveFailures: e.failures,
+			LastFailure:         e.lastFailure,
+			Current:             e == p.current,
+		})
+	}
+	return out
+}
@@ -1,6 +1,7 @@
 package connection
 
 import (
+	"context"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -11,23 +12,29 @@ func (c *Client) StartHeartbeat(interval time.Duration) {
 		interval = c.config.PingInterval
 	}
 
-	ticker := time.NewTicker(interval)
+	ticker := c.clock.NewTicker(interval)
+	c.wg.Add(1)
 	go func() {
+		defer c.wg.Done()
 		for {
 			select {
-			case <-ticker.C:
-				if !c.isConnected {
+			case <-ticker.C():
+				sess := c.current()
+				if !c.connected() || sess == nil {
 					continue
 				}
 
 				c.logger.Debug("Sending heartbeat")
-				deadline := time.Now().Add(c.config.WriteTimeout)
-				if err := c.WriteControl(websocket.PingMessage, []byte{}, deadline); err != nil {
-					c.logger.Error("Heartbeat failed: %v", err)
-					c.handleDisconnect()
+				ctx, cancel := context.WithTimeout(context.Background(), c.config.WriteTimeout)
+				err := c.sendControl(websocket.PingMessage, pingPayload(c.clock.Now())).Wait(ctx)
+				cancel()
+				if err != nil {
+					// A failed write has already been handled as a
+					// disconnect by the writer. A ping that never got
+					// written says nothing about the socket.
+					c.logger.Warn("Heartbeat not sent: %v", err)
 				} else {
 					c.logger.Debug("Heartbeat sent")
-					c.conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
 				}
 
 			case <-c.done:
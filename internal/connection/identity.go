@@ -0,0 +1,60 @@
+package connection
+
+import (
+	"hiurachat/internal/clock"
+	"hiurachat/internal/types"
+	"sync"
+	"time"
+)
+
+type Identity struct {
+	ID   string
+	Name string
+}
+
+type IdentityEvent struct {
+	Old Identity
+	New Identity
+	At  time.Time
+}
+
+// identityTracker remembers who the server says we are. Every getId reply is
+// treated as a (re)identification, since a reconnect may hand out a new
+// connectionId.
+type identityTracker struct {
+	mu      sync.Mutex
+	clock   clock.Clock
+	current Identity
+	events  broadcaster[IdentityEvent]
+}
+
+func (t *identityTracker) get() Identity {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.current
+}
+
+// observe updates the identity from resp and reports whether it changed.
+func (t *identityTracker) observe(resp types.Response) bool {
+	if !resp.IsIdentity() {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	next := Identity{ID: resp.ConnectionId, Name: resp.Name}
+	if next == t.current {
+		return false
+	}
+
+	event := IdentityEvent{
+		Old: t.current,
+		New: next,
+		At:  t.clock.Now(),
+	}
+	t.current = next
+	t.events.publish(event)
+	return true
+}
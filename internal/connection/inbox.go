@@ -0,0 +1,281 @@
+package connection
+
+import (
+	"encoding/json"
+	"fmt"
+	"hiurachat/internal/logger"
+	"hiurachat/internal/types"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	OverflowBlock      = "block"
+	OverflowDropOldest = "drop_oldest"
+	OverflowDropNewest = "drop_newest"
+	OverflowSpill      = "spill"
+)
+
+type InboxStats struct {
+	Policy   string
+	Buffered int
+	Dropped  uint64
+	Spilled  uint64
+	OnDisk   int
+}
+
+// inbox sits between the reader goroutine and Listen and decides what
+// happens when the handler falls behind.
+type inbox struct {
+	logger  *logger.Logger
+	policy  string
+	ch      chan types.Response
+	done    <-chan struct{}
+	mu      sync.Mutex
+	dropped atomic.Uint64
+	spilled atomic.Uint64
+	spill   *spillBuffer
+}
+
+func newInbox(logger *logger.Logger, policy string, size int, spillDir string, done <-chan struct{}) (*inbox, error) {
+	in := &inbox{
+		logger: logger,
+		policy: policy,
+		ch:     make(chan types.Response, size),
+		done:   done,
+	}
+
+	switch policy {
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest:
+	case OverflowSpill:
+		spill, err := newSpillBuffer(spillDir)
+		if err != nil {
+			return nil, err
+		}
+		in.spill = spill
+	default:
+		return nil, fmt.Errorf("unknown inbound overflow policy %q", policy)
+	}
+
+	return in, nil
+}
+
+func (in *inbox) push(resp types.Response) {
+	switch in.policy {
+	case OverflowBlock:
+		select {
+		case in.ch <- resp:
+		case <-in.done:
+		}
+
+	case OverflowDropNewest:
+		select {
+		case in.ch <- resp:
+		default:
+			in.drop("newest")
+		}
+
+	case OverflowDropOldest:
+		in.mu.Lock()
+		defer in.mu.Unlock()
+
+		for {
+			select {
+			case in.ch <- resp:
+				return
+			default:
+			}
+
+			select {
+			case <-in.ch:
+				in.drop("oldest")
+			default:
+			}
+		}
+
+	case OverflowSpill:
+		in.mu.Lock()
+		defer in.mu.Unlock()
+
+		if in.spill.len() == 0 {
+			select {
+			case in.ch <- resp:
+				return
+			default:
+				in.logger.Warn("Message channel full, spilling to %s", in.spill.path)
+			}
+		}
+
+		if err := in.spill.push(resp); err != nil {
+			in.logger.Error("Failed to spill message: %v", err)
+			in.drop("newest")
+			return
+		}
+		in.spilled.Add(1)
+	}
+}
+
+func (in *inbox) drop(which string) {
+	n := in.dropped.Add(1)
+	in.logger.Warn("Message channel full, dropped %s message (%d dropped so far)", which, n)
+}
+
+// drainSpill feeds spilled messages back into the channel in order as the
+// handler catches up. It only runs under the spill policy.
+func (in *inbox) drainSpill() {
+	for {
+		select {
+		case <-in.done:
+			return
+		case <-in.spill.notify:
+		}
+
+		for {
+			resp, ok, err := in.spill.peek()
+			if err != nil {
+				in.logger.Error("Failed to read spilled message: %v", err)
+				in.spill.pop()
+				in.dropped.Add(1)
+				continue
+			}
+			if !ok {
+				break
+			}
+
+			select {
+			case in.ch <- resp:
+				if in.spill.pop() == 0 {
+					in.logger.Info("Spilled messages drained")
+				}
+			case <-in.done:
+				return
+			}
+		}
+	}
+}
+
+func (in *inbox) stats() InboxStats {
+	stats := InboxStats{
+		Policy:   in.policy,
+		Buffered: len(in.ch),
+		Dropped:  in.dropped.Load(),
+		Spilled:  in.spilled.Load(),
+	}
+	if in.spill != nil {
+		stats.OnDisk = in.spill.len()
+	}
+	return stats
+}
+
+func (in *inbox) close() {
+	if in.spill != nil {
+		in.spill.close()
+	}
+}
+
+// spillBuffer is a FIFO of JSON encoded responses in a temporary file. Only
+// the offsets live in memory; the file is truncated whenever it runs empty.
+type spillBuffer struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	entries []spillEntry
+	size    int64
+	notify  chan struct{}
+}
+
+type spillEntry struct {
+	offset int64
+	length int
+}
+
+func newSpillBuffer(dir string) (*spillBuffer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spill directory: %v", err)
+	}
+
+	file, err := os.CreateTemp(dir, "inbound-*.jsonl")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spill file: %v", err)
+	}
+
+	return &spillBuffer{
+		path:   filepath.Clean(file.Name()),
+		file:   file,
+		notify: make(chan struct{}, 1),
+	}, nil
+}
+
+func (s *spillBuffer) push(resp types.Response) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.WriteAt(data, s.size); err != nil {
+		return err
+	}
+	s.entries = append(s.entries, spillEntry{offset: s.size, length: len(data)})
+	s.size += int64(len(data))
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *spillBuffer) peek() (types.Response, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var resp types.Response
+	if len(s.entries) == 0 {
+		return resp, false, nil
+	}
+
+	head := s.entries[0]
+	data := make([]byte, head.length)
+	if _, err := s.file.ReadAt(data, head.offset); err != nil {
+		return resp, false, err
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return resp, false, err
+	}
+	return resp, true, nil
+}
+
+// pop removes the head entry and returns how many are left.
+func (s *spillBuffer) pop() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) > 0 {
+		s.entries = s.entries[1:]
+	}
+	if len(s.entries) == 0 && s.size > 0 {
+		s.size = 0
+		s.file.Truncate(0)
+	}
+	return len(s.entries)
+}
+
+func (s *spillBuffer) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.entries)
+}
+
+func (s *spillBuffer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.file.Close()
+	os.Remove(s.path)
+}
@@ -3,67 +3,101 @@ package connection
 import (
 	"encoding/json"
 	"hiurachat/internal/types"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-func (c *Client) monitorConnection() {
-	c.setupPingPong()
+func (c *Client) monitorConnection(sess *session) {
+	defer c.wg.Done()
+	defer close(sess.done)
+	c.setupPingPong(sess)
 
 	for {
 		select {
 		case <-c.done:
 			return
 		default:
-			if err := c.readMessage(); err != nil {
-				c.handleDisconnect()
+			if err := c.readMessage(sess); err != nil {
+				c.handleDisconnect(sess, err)
 				return
 			}
 		}
 	}
 }
 
-func (c *Client) setupPingPong() {
-	c.conn.SetPingHandler(func(appData string) error {
+func (c *Client) setupPingPong(sess *session) {
+	sess.conn.SetPingHandler(func(appData string) error {
 		c.logger.Debug("Received ping")
-		c.conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
-		return c.conn.WriteControl(
-			websocket.PongMessage,
-			[]byte{},
-			time.Now().Add(c.config.PingTimeout),
-		)
+		sess.conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
+		c.sendControl(websocket.PongMessage, []byte(appData))
+		return nil
 	})
 
-	c.conn.SetPongHandler(func(appData string) error {
-		c.logger.Debug("Received pong")
-		c.conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
+	sess.conn.SetPongHandler(func(appData string) error {
+		sess.conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
+
+		sent, ok := parsePongPayload(appData)
+		if !ok {
+			c.logger.Debug("Received pong")
+			return nil
+		}
+
+		c.rtt.add(c.clock.Since(sent))
+		stats := c.rtt.stats()
+		c.logger.Debug("Received pong, RTT %v (min %v, avg %v, p50 %v, p99 %v over %d samples)",
+			stats.Last, stats.Min, stats.Avg, stats.P50, stats.P99, stats.Samples)
 		return nil
 	})
 }
 
-func (c *Client) readMessage() error {
-	c.conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
+func (c *Client) readMessage(sess *session) error {
+	sess.conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
 
 	var response types.Response
-	if err := c.conn.ReadJSON(&response); err != nil {
-		if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-			c.logger.Error("Unexpected close error: %v", err)
-		} else {
-			c.logger.Debug("Connection closed: %v", err)
-		}
+	if err := sess.conn.ReadJSON(&response); err != nil {
+		c.logger.Debug("Read failed: %v", err)
 		return err
 	}
 
+	if c.recorder != nil {
+		c.recorder.inbound(response)
+	}
+
+	if response.IsIdentity() {
+		c.identity.observe(response)
+		c.state.transition(StateIdentified, "identified as "+response.ConnectionId, StateConnected)
+	}
+	c.requests.resolve(response)
+
+	if isThrottleNotice(response) {
+		c.throttled(response.Message)
+	}
+
 	if data, err := json.Marshal(response); err == nil {
 		c.logger.Debug("Received message: %s", string(data))
 	}
 
-	select {
-	case c.messageChannel <- response:
-	default:
-		c.logger.Warn("Message channel full, dropping message")
-	}
+	c.inbox.push(response)
 
 	return nil
 }
+
+var throttleHints = []string{"rate limit", "slow down", "too many", "too fast"}
+
+// isThrottleNotice reports whether response is a server notice telling the
+// bot it is sending too fast.
+func isThrottleNotice(response types.Response) bool {
+	if response.Sender != "" || (response.Type != "" && response.Type != types.EventNotice) {
+		return false
+	}
+
+	message := strings.ToLower(response.Message)
+	for _, hint := range throttleHints {
+		if strings.Contains(message, hint) {
+			return true
+		}
+	}
+	return false
+}
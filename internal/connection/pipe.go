@@ -0,0 +1,147 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"hiurachat/internal/clock"
+	"hiurachat/internal/types"
+	"sync"
+)
+
+// Pipe is an in-memory Transport. Whatever the bot sends comes out of the
+// matching PipePeer, and responses the peer delivers are read by Listen.
+type Pipe struct {
+	state     *stateMachine
+	inbound   chan types.Response
+	outbound  chan types.Message
+	done      chan struct{}
+	closeOnce sync.Once
+	identity  identityTracker
+	requests  requestTracker
+}
+
+// PipePeer is the server side of a Pipe.
+type PipePeer struct {
+	pipe *Pipe
+}
+
+func NewPipe(buffer int) (*Pipe, *PipePeer) {
+	p := &Pipe{
+		state:    newStateMachine(clock.Real),
+		identity: identityTracker{clock: clock.Real},
+		inbound:  make(chan types.Response, buffer),
+		outbound: make(chan types.Message, buffer),
+		done:     make(chan struct{}),
+	}
+	return p, &PipePeer{pipe: p}
+}
+
+func (p *Pipe) Connect() error {
+	if !p.state.transition(StateConnecting, "opening pipe", StateIdle) {
+		return fmt.Errorf("cannot connect while %s", p.state.get())
+	}
+	p.state.transition(StateConnected, "pipe open", StateConnecting)
+	return nil
+}
+
+func (p *Pipe) Listen(handler func(types.Response)) {
+	for {
+		select {
+		case <-p.done:
+			return
+		case msg := <-p.inbound:
+			handler(msg)
+		}
+	}
+}
+
+func (p *Pipe) Send(msg types.Message) *Delivery {
+	return p.SendWithPriority(msg, PriorityInteractive)
+}
+
+// SendWithPriority hands msg to the peer. The pipe keeps no queue, so the
+// priority is ignored and anything sent while closed is dropped.
+func (p *Pipe) SendWithPriority(msg types.Message, priority Priority) *Delivery {
+	return p.SendContext(context.Background(), msg, priority)
+}
+
+// SendContext is SendWithPriority that stops waiting for the peer once ctx
+// ends.
+func (p *Pipe) SendContext(ctx context.Context, msg types.Message, priority Priority) *Delivery {
+	d := newDelivery()
+
+	if !p.state.is(StateConnected, StateIdentified) {
+		d.resolve(Dropped, fmt.Errorf("pipe is %s", p.state.get()))
+		return d
+	}
+
+	select {
+	case p.outbound <- msg:
+		d.resolve(Delivered, nil)
+	case <-p.done:
+		d.resolve(Dropped, fmt.Errorf("pipe closed"))
+	case <-ctx.Done():
+		d.resolve(Dropped, fmt.Errorf("send cancelled: %w", ctx.Err()))
+	}
+	return d
+}
+
+// UnderPressure is always false: the pipe has no rate limiter.
+func (p *Pipe) UnderPressure() bool {
+	return false
+}
+
+func (p *Pipe) Close(ctx context.Context) error {
+	p.closeOnce.Do(func() {
+		p.state.set(StateClosing, "close requested")
+		p.requests.failAll()
+		close(p.done)
+		p.state.set(StateClosed, "closed")
+	})
+	return nil
+}
+
+func (p *Pipe) State() State {
+	return p.state.get()
+}
+
+func (p *Pipe) Subscribe() (<-chan StateEvent, func()) {
+	return p.state.subscribe(16)
+}
+
+func (p *Pipe) Identity() Identity {
+	return p.identity.get()
+}
+
+func (p *Pipe) SubscribeIdentity() (<-chan IdentityEvent, func()) {
+	return p.identity.events.subscribe(4)
+}
+
+// Deliver queues resp for the bot's Listen loop, blocking while the pipe's
+// buffer is full.
+func (pp *PipePeer) Deliver(ctx context.Context, resp types.Response) error {
+	if resp.IsIdentity() {
+		pp.pipe.identity.observe(resp)
+		pp.pipe.state.transition(StateIdentified, "identified as "+resp.ConnectionId, StateConnected)
+	}
+	pp.pipe.requests.resolve(resp)
+
+	select {
+	case pp.pipe.inbound <- resp:
+		return nil
+	case <-pp.pipe.done:
+		return fmt.Errorf("pipe closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Outbound yields every message the bot sends through the pipe.
+func (pp *PipePeer) Outbound() <-chan types.Message {
+	return pp.pipe.outbound
+}
+
+// Done is closed once the bot side closes the pipe.
+func (pp *PipePeer) Done() <-chan struct{} {
+	return pp.pipe.done
+}
@@ -0,0 +1,108 @@
+package connection
+
+import (
+	"fmt"
+	"hiurachat/internal/config"
+	"math/rand/v2"
+	"time"
+)
+
+// ReconnectPolicy decides how long to wait before each reconnection attempt.
+// Attempts are numbered from zero; returning false gives up.
+type ReconnectPolicy interface {
+	NextDelay(attempt int) (time.Duration, bool)
+}
+
+// ExponentialBackoff doubles the delay ceiling on every attempt and picks a
+// random delay below it ("full jitter"). MaxAttempts of zero never gives up.
+type ExponentialBackoff struct {
+	Base        time.Duration
+	Max         time.Duration
+	MaxAttempts int
+}
+
+func (p ExponentialBackoff) NextDelay(attempt int) (time.Duration, bool) {
+	if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+		return 0, false
+	}
+
+	ceiling := p.Max
+	if attempt < 32 {
+		if d := p.Base << attempt; d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0, true
+	}
+
+	return time.Duration(rand.Int64N(int64(ceiling) + 1)), true
+}
+
+// FixedBackoff waits the same delay before every attempt. MaxAttempts of
+// zero never gives up.
+type FixedBackoff struct {
+	Delay       time.Duration
+	MaxAttempts int
+}
+
+func (p FixedBackoff) NextDelay(attempt int) (time.Duration, bool) {
+	if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+		return 0, false
+	}
+	return p.Delay, true
+}
+
+// UnlimitedBackoff behaves like ExponentialBackoff but never gives up.
+type UnlimitedBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+func (p UnlimitedBackoff) NextDelay(attempt int) (time.Duration, bool) {
+	return ExponentialBackoff{Base: p.Base, Max: p.Max}.NextDelay(attempt)
+}
+
+func NewReconnectPolicy(cfg config.ReconnectConfig) (ReconnectPolicy, error) {
+	switch cfg.Policy {
+	case "exponential":
+		return ExponentialBackoff{
+			Base:        cfg.BaseDelay,
+			Max:         cfg.MaxDelay,
+			MaxAttempts: maxAttempts(cfg),
+		}, nil
+	case "fixed":
+		return FixedBackoff{
+			Delay:       cfg.BaseDelay,
+			MaxAttempts: maxAttempts(cfg),
+		}, nil
+	case "unlimited":
+		return UnlimitedBackoff{
+			Base: cfg.BaseDelay,
+			Max:  cfg.MaxDelay,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown reconnect policy %q", cfg.Policy)
+}
+
+// maxAttempts is cfg's attempt limit. It is only unset when the config
+// defaults were never applied, in which case the policy never gives up.
+func maxAttempts(cfg config.ReconnectConfig) int {
+	if cfg.MaxAttempts == nil {
+		return 0
+	}
+	return *cfg.MaxAttempts
+}
+
+// newNetworkPolicy builds the backoff track used for DNS and TLS failures. It
+// shares the attempt limit of the main policy but starts from a longer delay.
+func newNetworkPolicy(cfg config.ReconnectConfig) ReconnectPolicy {
+	if cfg.Policy == "unlimited" {
+		return UnlimitedBackoff{Base: cfg.NetworkBaseDelay, Max: cfg.NetworkMaxDelay}
+	}
+	return ExponentialBackoff{
+		Base:        cfg.NetworkBaseDelay,
+		Max:         cfg.NetworkMaxDelay,
+		MaxAttempts: maxAttempts(cfg),
+	}
+}
@@ -0,0 +1,322 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"hiurachat/internal/clock"
+	"sync"
+	"time"
+)
+
+type DeliveryStatus int
+
+const (
+	Pending DeliveryStatus = iota
+	Delivered
+	Expired
+	Dropped
+)
+
+func (s DeliveryStatus) String() string {
+	switch s {
+	case Pending:
+		return "pending"
+	case Delivered:
+		return "delivered"
+	case Expired:
+		return "expired"
+	case Dropped:
+		return "dropped"
+	}
+	return "unknown"
+}
+
+// Delivery reports what eventually happened to a message handed to Send.
+type Delivery struct {
+	done   chan struct{}
+	once   sync.Once
+	status DeliveryStatus
+	err    error
+}
+
+func newDelivery() *Delivery {
+	return &Delivery{done: make(chan struct{})}
+}
+
+func (d *Delivery) resolve(status DeliveryStatus, err error) {
+	d.once.Do(func() {
+		d.status = status
+		d.err = err
+		close(d.done)
+	})
+}
+
+// Done is closed once the message has been delivered, expired or dropped.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *Delivery) Status() DeliveryStatus {
+	select {
+	case <-d.done:
+		return d.status
+	default:
+		return Pending
+	}
+}
+
+func (d *Delivery) Err() error {
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the message leaves the queue and returns nil only if it
+// was actually written to the connection.
+func (d *Delivery) Wait(ctx context.Context) error {
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type Priority int
+
+const (
+	PriorityControl Priority = iota
+	PriorityInteractive
+	PriorityBulk
+	// priorityFrame carries WebSocket ping, pong and close frames. It is
+	// never rate limited and is served before every other lane, so a held
+	// back request cannot delay them.
+	priorityFrame
+
+	laneCount = int(priorityFrame) + 1
+)
+
+// laneOrder is the order in which next serves the lanes.
+var laneOrder = [laneCount]Priority{priorityFrame, PriorityControl, PriorityInteractive, PriorityBulk}
+
+// control reports whether p bypasses max_size and is served while the queue
+// is paused.
+func (p Priority) control() bool {
+	return p == PriorityControl || p == priorityFrame
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityControl:
+		return "control"
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityBulk:
+		return "bulk"
+	case priorityFrame:
+		return "frame"
+	}
+	return "unknown"
+}
+
+type queuedMessage struct {
+	route     string
+	target    string
+	frameType int
+	payload   []byte
+	priority  Priority
+	ttl       time.Duration
+	delivery  *Delivery
+	expiry    clock.Timer
+	// expires is when the message expires. It keeps its place in time
+	// when a failed write puts the message back.
+	expires time.Time
+	// ctx is the caller's context, if any. The message is dropped once it
+	// ends.
+	ctx context.Context
+	// stopCancel detaches the message from ctx.
+	stopCancel func() bool
+	// held is set once the rate limiter has refused the message.
+	held bool
+}
+
+// outboundQueue holds everything waiting for the writer goroutine, one FIFO
+// lane per priority. While paused only the control and frame lanes are
+// handed out, which lets a reconnect identify itself before older chat
+// traffic is flushed.
+type outboundQueue struct {
+	mu      sync.Mutex
+	lanes   [laneCount][]*queuedMessage
+	size    int
+	maxSize int
+	paused  bool
+	wake    chan struct{}
+	clock   clock.Clock
+	// discarded, if set, is called for every message that leaves the queue
+	// expired or dropped. It runs with the queue locked.
+	discarded func(*queuedMessage)
+}
+
+func newOutboundQueue(maxSize int, clk clock.Clock) *outboundQueue {
+	return &outboundQueue{
+		maxSize: maxSize,
+		wake:    make(chan struct{}, 1),
+		clock:   clk,
+	}
+}
+
+func (q *outboundQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *outboundQueue) push(msg *queuedMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.size >= q.maxSize && !msg.priority.control() {
+		msg.delivery.resolve(Dropped, fmt.Errorf("outbound queue full (%d messages)", q.maxSize))
+		return
+	}
+
+	msg.expires = q.clock.Now().Add(msg.ttl)
+	q.arm(msg, msg.ttl)
+	q.lanes[msg.priority] = append(q.lanes[msg.priority], msg)
+	q.size++
+	q.signal()
+}
+
+// arm starts msg's expiry timer and ties it to its caller's context. Must be
+// called with q.mu held.
+func (q *outboundQueue) arm(msg *queuedMessage, ttl time.Duration) {
+	msg.expiry = q.clock.AfterFunc(ttl, func() { q.expire(msg) })
+	if msg.ctx != nil && msg.ctx.Done() != nil {
+		msg.stopCancel = context.AfterFunc(msg.ctx, func() { q.cancel(msg, msg.ctx.Err()) })
+	}
+}
+
+func (q *outboundQueue) expire(msg *queuedMessage) {
+	q.remove(msg, Expired, fmt.Errorf("message expired after %v in outbound queue", msg.ttl))
+}
+
+// cancel drops msg if it is still queued when its caller's context ends.
+func (q *outboundQueue) cancel(msg *queuedMessage, err error) {
+	q.remove(msg, Dropped, fmt.Errorf("send cancelled: %w", err))
+}
+
+func (q *outboundQueue) remove(msg *queuedMessage, status DeliveryStatus, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	lane := q.lanes[msg.priority]
+	for i, m := range lane {
+		if m == msg {
+			q.lanes[msg.priority] = append(lane[:i], lane[i+1:]...)
+			q.size--
+			msg.expiry.Stop()
+			msg.delivery.resolve(status, err)
+			q.discard(msg)
+			return
+		}
+	}
+}
+
+func (q *outboundQueue) discard(msg *queuedMessage) {
+	if q.discarded != nil {
+		q.discarded(msg)
+	}
+}
+
+// next hands out the head of the highest priority lane that acquire lets
+// through. When nothing can go yet it returns the shortest wait reported by
+// acquire, or zero if there is nothing to send at all.
+func (q *outboundQueue) next(acquire func(*queuedMessage) (time.Duration, bool)) (*queuedMessage, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var wait time.Duration
+	for _, p := range laneOrder {
+		if q.paused && !p.control() {
+			break
+		}
+
+		lane := q.lanes[p]
+		if len(lane) == 0 {
+			continue
+		}
+
+		retryAfter, ok := acquire(lane[0])
+		if !ok {
+			if wait == 0 || retryAfter < wait {
+				wait = retryAfter
+			}
+			continue
+		}
+
+		msg := lane[0]
+		q.lanes[p] = lane[1:]
+		q.size--
+		msg.expiry.Stop()
+		if msg.stopCancel != nil {
+			msg.stopCancel()
+		}
+		return msg, 0
+	}
+
+	return nil, wait
+}
+
+// requeue puts msg back at the head of its lane after a failed write. It
+// keeps its original expiry and follows its caller's context again.
+func (q *outboundQueue) requeue(msg *queuedMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ttl := msg.expires.Sub(q.clock.Now())
+	if ttl <= 0 {
+		msg.delivery.resolve(Expired, fmt.Errorf("message expired after %v in outbound queue", msg.ttl))
+		q.discard(msg)
+		return
+	}
+
+	q.lanes[msg.priority] = append([]*queuedMessage{msg}, q.lanes[msg.priority]...)
+	q.size++
+	q.arm(msg, ttl)
+}
+
+func (q *outboundQueue) setPaused(paused bool) {
+	q.mu.Lock()
+	q.paused = paused
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *outboundQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.size
+}
+
+func (q *outboundQueue) dropAll(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for p, lane := range q.lanes {
+		for _, msg := range lane {
+			msg.expiry.Stop()
+			if msg.stopCancel != nil {
+				msg.stopCancel()
+			}
+			msg.delivery.resolve(Dropped, err)
+			q.discard(msg)
+		}
+		q.lanes[p] = nil
+	}
+	q.size = 0
+}
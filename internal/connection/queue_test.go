@@ -0,0 +1,126 @@
+package connection
+
+import (
+	"context"
+	"hiurachat/internal/clock"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func admitAll(*queuedMessage) (time.Duration, bool) { return 0, true }
+
+func queued(ctx context.Context, ttl time.Duration) *queuedMessage {
+	return &queuedMessage{
+		route:     "sendMessage",
+		frameType: websocket.TextMessage,
+		priority:  PriorityInteractive,
+		ttl:       ttl,
+		delivery:  newDelivery(),
+		ctx:       ctx,
+	}
+}
+
+// resolved waits for d to leave the queue and returns its status.
+func resolved(t *testing.T, d *Delivery) DeliveryStatus {
+	t.Helper()
+
+	select {
+	case <-d.Done():
+		return d.Status()
+	case <-time.After(time.Second):
+		t.Fatal("the message never left the queue")
+		return Pending
+	}
+}
+
+func TestRequeueKeepsExpiry(t *testing.T) {
+	fake := clock.NewFake(epoch)
+	q := newOutboundQueue(10, fake)
+
+	msg := queued(context.Background(), 10*time.Second)
+	q.push(msg)
+	if got, _ := q.next(admitAll); got != msg {
+		t.Fatal("next did not hand out the message")
+	}
+
+	// The write takes 4s and fails.
+	fake.Advance(4 * time.Second)
+	q.requeue(msg)
+
+	fake.Advance(5 * time.Second)
+	if got := msg.delivery.Status(); got != Pending {
+		t.Fatalf("message is %s 9s after it was queued", got)
+	}
+	fake.Advance(time.Second)
+	if got := resolved(t, msg.delivery); got != Expired {
+		t.Fatalf("message is %s 10s after it was queued, want expired", got)
+	}
+	if q.len() != 0 {
+		t.Errorf("%d messages left in the queue", q.len())
+	}
+}
+
+func TestRequeueExpiredMessage(t *testing.T) {
+	fake := clock.NewFake(epoch)
+	q := newOutboundQueue(10, fake)
+
+	msg := queued(context.Background(), time.Second)
+	q.push(msg)
+	q.next(admitAll)
+
+	fake.Advance(2 * time.Second)
+	q.requeue(msg)
+	if got := resolved(t, msg.delivery); got != Expired {
+		t.Fatalf("message is %s, want expired", got)
+	}
+	if q.len() != 0 {
+		t.Errorf("%d messages left in the queue", q.len())
+	}
+}
+
+func TestRequeueFollowsCallerContext(t *testing.T) {
+	q := newOutboundQueue(10, clock.NewFake(epoch))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msg := queued(ctx, time.Minute)
+	q.push(msg)
+	q.next(admitAll)
+	q.requeue(msg)
+
+	cancel()
+	if got := resolved(t, msg.delivery); got != Dropped {
+		t.Fatalf("message is %s after its context ended, want dropped", got)
+	}
+	if q.len() != 0 {
+		t.Errorf("%d messages left in the queue", q.len())
+	}
+}
+
+func TestFramesBypassHeldRequests(t *testing.T) {
+	q := newOutboundQueue(1, clock.NewFake(epoch))
+
+	getID := queued(context.Background(), time.Minute)
+	getID.route, getID.priority = "getId", PriorityControl
+	q.push(getID)
+
+	ping := &queuedMessage{frameType: websocket.PingMessage, priority: priorityFrame, ttl: time.Second, delivery: newDelivery()}
+	q.push(ping)
+	if ping.delivery.Status() != Pending {
+		t.Fatal("a ping was turned away by max_size")
+	}
+
+	// The rate limiter holds every text frame back.
+	holdText := func(msg *queuedMessage) (time.Duration, bool) {
+		return 5 * time.Second, msg.frameType != websocket.TextMessage
+	}
+
+	q.setPaused(true)
+	if got, _ := q.next(holdText); got != ping {
+		t.Fatal("the ping was stuck behind a held getId")
+	}
+	if got, wait := q.next(holdText); got != nil || wait != 5*time.Second {
+		t.Fatalf("next = %v, %v; want the getId held for 5s", got, wait)
+	}
+}
@@ -1,67 +1,217 @@
 package connection
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"hiurachat/internal/types"
 	"time"
 )
 
-func (c *Client) handleDisconnect() {
-	c.writeMu.Lock()
-	wasConnected := c.isConnected
-	c.isConnected = false
-	c.writeMu.Unlock()
+// errSuperseded is returned by reconnect when the new session was lost while
+// identifying and its own disconnect handling has taken over.
+var errSuperseded = errors.New("reconnect superseded by a newer disconnect")
 
-	if wasConnected && !c.reconnecting {
-		go c.reconnectWithBackoff()
+// handleDisconnect classifies cause and either starts reconnecting or, for
+// fatal closes, gives up for good. It does nothing if sess has already been
+// replaced, in which case the failure belongs to a socket nobody uses any more.
+func (c *Client) handleDisconnect(sess *session, cause error) {
+	if sess != c.current() {
+		return
+	}
+
+	d := classifyDisconnect(cause)
+	if d.Category == DisconnectFatal {
+		if c.state.transition(StateGaveUp, d.String(), StateConnected, StateIdentified) {
+			c.requests.failAll()
+			c.queue.setPaused(true)
+			c.raiseFatal(d)
+		}
+		return
+	}
+
+	if c.state.transition(StateReconnecting, d.String(), StateConnected, StateIdentified) {
+		c.logDisconnect(d)
+		if d.Category == DisconnectTryLater || d.Category == DisconnectTransient {
+			c.throttled(d.String())
+		}
+		c.requests.failAll()
+		c.queue.setPaused(true)
+		c.startReconnect(c.reconnectPolicy, d)
+	}
+}
+
+func (c *Client) logDisconnect(d Disconnect) {
+	switch d.Category {
+	case DisconnectNormal:
+		c.logger.Warn("Connection closed by server (%s), reconnecting immediately", d)
+	case DisconnectTryLater:
+		c.logger.Warn("Server asked to try again later (%s)", d)
+	case DisconnectNetwork:
+		c.logger.Error("Network failure (%s), using network backoff", d)
+	default:
+		c.logger.Error("Connection lost (%s)", d)
 	}
 }
 
-func (c *Client) reconnectWithBackoff() {
-	c.reconnecting = true
-	defer func() { c.reconnecting = false }()
-
-	backoff := []time.Duration{
-		1 * time.Second,
-		2 * time.Second,
-		5 * time.Second,
-		10 * time.Second,
-		30 * time.Second,
-		60 * time.Second,
+// throttled lets an adaptive rate limiter lower its rate when the server
+// pushed back right after a burst of sends.
+func (c *Client) throttled(reason string) {
+	if c.rateLimiter != nil && c.rateLimiter.Throttled() {
+		c.logger.Warn("Lowering send rate after server throttling (%s)", reason)
 	}
+}
 
-	for attempt := 0; attempt < c.config.MaxReconnectAttempts && !c.isConnected; attempt++ {
-		select {
-		case <-c.done:
+// SetOnGiveUp registers fn to be called when a reconnect policy gives up.
+// It runs after the reconnect loop has finished, so it may call ReconnectWith.
+func (c *Client) SetOnGiveUp(fn func(attempts int, err error)) {
+	c.mu.Lock()
+	c.onGiveUp = fn
+	c.mu.Unlock()
+}
+
+// SetOnFatal registers fn to be called when the server closes or refuses the
+// connection in a way that reconnecting cannot fix, such as a policy
+// violation or rejected credentials. The client is in StateGaveUp by then.
+func (c *Client) SetOnFatal(fn func(Disconnect)) {
+	c.mu.Lock()
+	c.onFatal = fn
+	c.mu.Unlock()
+}
+
+func (c *Client) raiseFatal(d Disconnect) {
+	c.logger.Error("Connection rejected (%s), not reconnecting", d)
+
+	c.mu.Lock()
+	onFatal := c.onFatal
+	c.mu.Unlock()
+
+	if onFatal != nil {
+		onFatal(d)
+	}
+}
+
+// ReconnectWith starts a new reconnect loop driven by policy after a previous
+// policy gave up. It does nothing in any other state.
+func (c *Client) ReconnectWith(policy ReconnectPolicy) {
+	if c.state.transition(StateReconnecting, "retrying with a new policy", StateGaveUp) {
+		c.startReconnect(policy, Disconnect{Category: DisconnectTransient})
+	}
+}
+
+func (c *Client) startReconnect(policy ReconnectPolicy, cause Disconnect) {
+	go func() {
+		attempts, err := c.reconnectWithBackoff(policy, cause)
+		if err == nil {
 			return
-		default:
-			delay := backoff[min(attempt, len(backoff)-1)]
-			c.logger.Debug("Attempting reconnection in %v (attempt %d/%d)",
-				delay, attempt+1, c.config.MaxReconnectAttempts)
+		}
+
+		if !c.state.transition(StateGaveUp, err.Error(), StateReconnecting) {
+			return
+		}
+
+		c.mu.Lock()
+		onGiveUp := c.onGiveUp
+		c.mu.Unlock()
+
+		if onGiveUp != nil {
+			onGiveUp(attempts, err)
+		}
+	}()
+}
+
+// reconnectWithBackoff returns the last error once policy gives up, or nil
+// when the client reconnected, was closed, or hit a fatal close in the
+// meantime. DNS and TLS failures advance the network track instead of policy,
+// so a flaky resolver does not use up the attempts meant for the server.
+func (c *Client) reconnectWithBackoff(policy ReconnectPolicy, cause Disconnect) (int, error) {
+	var (
+		lastErr         error
+		failures        int
+		networkFailures int
+	)
+
+	for attempt := 0; ; attempt++ {
+		var (
+			delay time.Duration
+			ok    = true
+		)
 
-			time.Sleep(delay)
+		switch {
+		case cause.Category == DisconnectNormal && attempt == 0:
+		case cause.Category == DisconnectNetwork:
+			delay, ok = c.networkPolicy.NextDelay(networkFailures)
+		default:
+			delay, ok = policy.NextDelay(failures)
+			delay = max(delay, cause.RetryAfter)
+		}
 
-			if err := c.reconnect(); err != nil {
-				c.logger.Error("Reconnection attempt failed: %v", err)
-				continue
+		if !ok {
+			if lastErr == nil {
+				lastErr = fmt.Errorf("reconnect policy allowed no attempts")
 			}
+			c.logger.Error("Giving up after %d reconnection attempts: %v", attempt, lastErr)
+			return attempt, lastErr
+		}
+
+		c.logger.Debug("Attempting reconnection in %v (attempt %d)", delay, attempt+1)
+
+		select {
+		case <-c.done:
+			return attempt, nil
+		case <-c.clock.After(delay):
+		}
 
+		err := c.reconnect()
+		if err == nil {
 			c.logger.Debug("Successfully reconnected")
-			return
+			return attempt + 1, nil
+		}
+		if errors.Is(err, errSuperseded) {
+			return attempt + 1, nil
+		}
+
+		lastErr = err
+		cause = classifyDisconnect(err)
+
+		switch cause.Category {
+		case DisconnectFatal:
+			if c.state.transition(StateGaveUp, cause.String(), StateReconnecting) {
+				c.raiseFatal(cause)
+			}
+			return attempt + 1, nil
+		case DisconnectNetwork:
+			networkFailures++
+		default:
+			failures++
 		}
-	}
 
-	if !c.isConnected {
-		c.logger.Error("Max reconnection attempts reached, giving up")
+		c.logger.Error("Reconnection attempt %d failed (%s)", attempt+1, cause)
 	}
 }
 
 func (c *Client) reconnect() error {
-	if c.conn != nil {
-		c.conn.Close()
+	if sess := c.current(); sess != nil {
+		sess.conn.Close()
 	}
 
 	if err := c.Connect(); err != nil {
 		return err
 	}
 
-	return c.RequestID()
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.ReadTimeout)
+	defer cancel()
+
+	if _, err := c.Request(ctx, types.Message{Action: "getId"}); err != nil {
+		err = fmt.Errorf("failed to identify: %w", err)
+		// Take the session back before the monitor notices it closing, or
+		// let its disconnect handling win if it already has.
+		if !c.state.transition(StateReconnecting, err.Error(), StateConnected, StateIdentified) {
+			return errSuperseded
+		}
+		return err
+	}
+
+	c.queue.setPaused(false)
+	return nil
 }
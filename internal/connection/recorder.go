@@ -0,0 +1,106 @@
+package connection
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hiurachat/internal/clock"
+	"hiurachat/internal/types"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	FrameInbound  = "in"
+	FrameOutbound = "out"
+)
+
+// Frame is one line of a recording: a response read from the server or a
+// message written to it.
+type Frame struct {
+	At        time.Time       `json:"at"`
+	Direction string          `json:"dir"`
+	Response  *types.Response `json:"response,omitempty"`
+	Message   *types.Message  `json:"message,omitempty"`
+}
+
+// recorder appends frames to a JSONL file. Every frame is written straight
+// through, so a crash loses nothing that was already recorded.
+type recorder struct {
+	mu    sync.Mutex
+	clock clock.Clock
+	file  *os.File
+	enc   *json.Encoder
+}
+
+func newRecorder(path string, clk clock.Clock) (*recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	return &recorder{clock: clk, file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (r *recorder) inbound(resp types.Response) {
+	r.write(Frame{At: r.clock.Now(), Direction: FrameInbound, Response: &resp})
+}
+
+func (r *recorder) outbound(payload []byte) {
+	var msg types.Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return
+	}
+	r.write(Frame{At: r.clock.Now(), Direction: FrameOutbound, Message: &msg})
+}
+
+func (r *recorder) write(f Frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file != nil {
+		r.enc.Encode(f)
+	}
+}
+
+func (r *recorder) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// ReadRecording loads every frame of a recording made with websocket.record.
+func ReadRecording(path string) ([]Frame, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var frames []Frame
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var f Frame
+		if err := json.Unmarshal(scanner.Bytes(), &f); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		frames = append(frames, f)
+	}
+	return frames, scanner.Err()
+}
@@ -0,0 +1,37 @@
+package connection
+
+import (
+	"hiurachat/internal/clock"
+	"hiurachat/internal/types"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecorderAppendsAcrossRuns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recordings", "session.jsonl")
+	fake := clock.NewFake(epoch)
+
+	for _, id := range []string{"first", "second"} {
+		fake.Advance(time.Minute)
+		r, err := newRecorder(path, fake)
+		if err != nil {
+			t.Fatalf("newRecorder: %v", err)
+		}
+		r.inbound(types.Response{Type: "identity", ConnectionId: id})
+		if err := r.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	frames, err := ReadRecording(path)
+	if err != nil {
+		t.Fatalf("ReadRecording: %v", err)
+	}
+	if len(frames) != 2 || frames[0].Response.ConnectionId != "first" || frames[1].Response.ConnectionId != "second" {
+		t.Fatalf("recording holds %+v, want both runs in order", frames)
+	}
+	if !frames[1].At.Equal(epoch.Add(2 * time.Minute)) {
+		t.Errorf("second frame recorded at %v, want the clock's time", frames[1].At)
+	}
+}
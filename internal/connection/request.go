@@ -0,0 +1,124 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"hiurachat/internal/types"
+	"sync"
+)
+
+// replyMatchers recognizes the response that answers each request-style
+// action. The protocol carries no request IDs, so replies to the same action
+// are matched to requests in the order the requests were made.
+var replyMatchers = map[string]func(types.Response) bool{
+	"getId": types.Response.IsIdentity,
+}
+
+type pendingRequest struct {
+	action string
+	reply  chan types.Response
+}
+
+type requestTracker struct {
+	mu      sync.Mutex
+	pending []*pendingRequest
+}
+
+func (t *requestTracker) add(action string) (*pendingRequest, error) {
+	if _, ok := replyMatchers[action]; !ok {
+		return nil, fmt.Errorf("action %q has no known reply", action)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := &pendingRequest{
+		action: action,
+		reply:  make(chan types.Response, 1),
+	}
+	t.pending = append(t.pending, p)
+	return p, nil
+}
+
+func (t *requestTracker) remove(p *pendingRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, q := range t.pending {
+		if q == p {
+			t.pending = append(t.pending[:i], t.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// resolve hands resp to the oldest request it answers and reports whether
+// there was one.
+func (t *requestTracker) resolve(resp types.Response) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, p := range t.pending {
+		if replyMatchers[p.action](resp) {
+			t.pending = append(t.pending[:i], t.pending[i+1:]...)
+			p.reply <- resp
+			return true
+		}
+	}
+	return false
+}
+
+// failAll abandons every pending request, e.g. because the connection they
+// were sent on is gone and their replies will never arrive.
+func (t *requestTracker) failAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, p := range t.pending {
+		close(p.reply)
+	}
+	t.pending = nil
+}
+
+// await sends msg through send and waits for the matching reply.
+func (t *requestTracker) await(ctx context.Context, msg types.Message, send func(types.Message) *Delivery) (types.Response, error) {
+	p, err := t.add(msg.Action)
+	if err != nil {
+		return types.Response{}, err
+	}
+
+	d := send(msg)
+	written := d.Done()
+	for {
+		select {
+		case resp, ok := <-p.reply:
+			if !ok {
+				return types.Response{}, fmt.Errorf("connection lost before %s was answered", msg.Action)
+			}
+			return resp, nil
+		case <-written:
+			if err := d.Err(); err != nil {
+				t.remove(p)
+				return types.Response{}, err
+			}
+			written = nil
+		case <-ctx.Done():
+			t.remove(p)
+			return types.Response{}, ctx.Err()
+		}
+	}
+}
+
+// Request sends a request-style action on the control lane and waits for the
+// reply that answers it. If ctx ends while the request is still queued, it
+// is dropped rather than sent for nobody.
+func (c *Client) Request(ctx context.Context, msg types.Message) (types.Response, error) {
+	return c.requests.await(ctx, msg, func(m types.Message) *Delivery {
+		return c.SendContext(ctx, m, PriorityControl)
+	})
+}
+
+// Request sends msg to the peer and waits for the reply that answers it.
+func (p *Pipe) Request(ctx context.Context, msg types.Message) (types.Response, error) {
+	return p.requests.await(ctx, msg, p.Send)
+}
@@ -0,0 +1,103 @@
+package connection
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+type RTTStats struct {
+	Samples int
+	Last    time.Duration
+	Min     time.Duration
+	Avg     time.Duration
+	P50     time.Duration
+	P99     time.Duration
+}
+
+// rttWindow keeps the most recent heartbeat round trips in a ring buffer.
+type rttWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+	last    time.Duration
+}
+
+// defaultRTTWindow is the window size used when none is configured.
+const defaultRTTWindow = 100
+
+func newRTTWindow(size int) *rttWindow {
+	if size <= 0 {
+		size = defaultRTTWindow
+	}
+	return &rttWindow{samples: make([]time.Duration, size)}
+}
+
+func (w *rttWindow) add(rtt time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.samples[w.next] = rtt
+	w.next = (w.next + 1) % len(w.samples)
+	if w.next == 0 {
+		w.full = true
+	}
+	w.last = rtt
+}
+
+func (w *rttWindow) stats() RTTStats {
+	w.mu.Lock()
+	n := w.next
+	if w.full {
+		n = len(w.samples)
+	}
+	sorted := slices.Clone(w.samples[:n])
+	last := w.last
+	w.mu.Unlock()
+
+	if n == 0 {
+		return RTTStats{}
+	}
+	slices.Sort(sorted)
+
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+
+	return RTTStats{
+		Samples: n,
+		Last:    last,
+		Min:     sorted[0],
+		Avg:     sum / time.Duration(n),
+		P50:     percentile(sorted, 0.50),
+		P99:     percentile(sorted, 0.99),
+	}
+}
+
+// percentile uses the nearest-rank method on an already sorted slice.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(rank, 0)]
+}
+
+// pingPayload stamps a heartbeat ping with its send time so the matching
+// pong tells us the round trip.
+func pingPayload(now time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+}
+
+func parsePongPayload(data string) (time.Time, bool) {
+	if len(data) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64([]byte(data)))), true
+}
+
+// RTT summarizes recent heartbeat round trips.
+func (c *Client) RTT() RTTStats {
+	return c.rtt.stats()
+}
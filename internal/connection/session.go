@@ -0,0 +1,46 @@
+package connection
+
+import "github.com/gorilla/websocket"
+
+// session is one dialed socket. Goroutines keep the session they were
+// started for, so a reader or writer that outlives a reconnect can only ever
+// touch its own, already dead, socket.
+type session struct {
+	conn     *websocket.Conn
+	endpoint *endpoint
+	done     chan struct{}
+}
+
+func newSession(conn *websocket.Conn, ep *endpoint) *session {
+	return &session{
+		conn:     conn,
+		endpoint: ep,
+		done:     make(chan struct{}),
+	}
+}
+
+// alive reports whether the reader for this session is still running.
+func (s *session) alive() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *Client) current() *session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.session
+}
+
+func (c *Client) swapSession(s *session) *session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old := c.session
+	c.session = s
+	return old
+}
@@ -0,0 +1,116 @@
+package connection
+
+import (
+	"hiurachat/internal/clock"
+	"slices"
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	StateIdle State = iota
+	StateConnecting
+	StateConnected
+	StateIdentified
+	StateReconnecting
+	StateClosing
+	StateClosed
+	StateGaveUp
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateIdentified:
+		return "identified"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosing:
+		return "closing"
+	case StateClosed:
+		return "closed"
+	case StateGaveUp:
+		return "gave up"
+	}
+	return "unknown"
+}
+
+type StateEvent struct {
+	From  State
+	To    State
+	At    time.Time
+	Cause string
+}
+
+// stateMachine owns the connection state and fans transitions out to
+// subscribers.
+type stateMachine struct {
+	mu      sync.Mutex
+	clock   clock.Clock
+	current State
+	events  broadcaster[StateEvent]
+}
+
+func newStateMachine(clk clock.Clock) *stateMachine {
+	return &stateMachine{clock: clk, current: StateIdle}
+}
+
+func (m *stateMachine) get() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.current
+}
+
+func (m *stateMachine) is(states ...State) bool {
+	return slices.Contains(states, m.get())
+}
+
+// transition moves to `to` if the current state is one of `from`, or
+// unconditionally when `from` is empty. It reports whether it moved.
+func (m *stateMachine) transition(to State, cause string, from ...State) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(from) > 0 && !slices.Contains(from, m.current) {
+		return false
+	}
+	return m.moveLocked(to, cause)
+}
+
+// set moves to `to` unconditionally and returns the state it left.
+func (m *stateMachine) set(to State, cause string) State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := m.current
+	m.moveLocked(to, cause)
+	return prev
+}
+
+func (m *stateMachine) moveLocked(to State, cause string) bool {
+	if m.current == to {
+		return false
+	}
+
+	event := StateEvent{
+		From:  m.current,
+		To:    to,
+		At:    m.clock.Now(),
+		Cause: cause,
+	}
+	m.current = to
+	m.events.publish(event)
+	return true
+}
+
+func (m *stateMachine) subscribe(buffer int) (<-chan StateEvent, func()) {
+	return m.events.subscribe(buffer)
+}
@@ -0,0 +1,199 @@
+package connection
+
+import (
+	"context"
+	"hiurachat/internal/clock"
+	"hiurachat/internal/config"
+	"hiurachat/internal/mockserver"
+	"hiurachat/internal/ratelimit"
+	"hiurachat/internal/types"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newFakeClockClient is newTestClient driven by a fake clock.
+func newFakeClockClient(t *testing.T, url string, configure func(*config.WebSocketConfig)) (*Client, *clock.Fake) {
+	t.Helper()
+
+	fake := clock.NewFake(epoch)
+	cfg := testConfig(url)
+	cfg.Clock = fake
+	configure(cfg)
+	return newTestClient(t, cfg), fake
+}
+
+// settle waits for the client to park on exactly n fake timers, so an
+// Advance cannot race the code that is about to wait.
+func settle(t *testing.T, fake *clock.Fake, n int) {
+	t.Helper()
+	waitFor(t, "the client to wait on the clock", func() bool { return fake.Waiters() == n })
+}
+
+func TestReconnectBackoffFollowsClock(t *testing.T) {
+	var (
+		down      atomic.Bool
+		handshake atomic.Int32
+	)
+	mock := mockserver.New(testLogger(), mockserver.Options{Faults: mockserver.Faults{DropAfter: 2}})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handshake.Add(1)
+		if down.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	c, fake := newFakeClockClient(t, wsURL(srv), func(cfg *config.WebSocketConfig) {
+		cfg.Reconnect.BaseDelay = time.Minute
+		cfg.Reconnect.NetworkBaseDelay = time.Minute
+		cfg.Reconnect.NetworkMaxDelay = time.Minute
+	})
+
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	go c.Listen(func(types.Response) {})
+	c.RequestID()
+	waitFor(t, "the client to identify", func() bool { return c.State() == StateIdentified })
+
+	// The server cuts the connection on the frame after getId and then
+	// refuses handshakes.
+	down.Store(true)
+	c.Send(chat("dropped by the server"))
+	waitFor(t, "the client to reconnect", func() bool { return c.State() == StateReconnecting })
+	settle(t, fake, 1)
+
+	schedule := []struct {
+		advance    time.Duration
+		handshakes int32
+	}{
+		{59 * time.Second, 1},
+		// The first attempt at 60s is refused.
+		{time.Second, 2},
+		{59 * time.Second, 2},
+		// So is the second at 120s.
+		{time.Second, 3},
+	}
+	for _, step := range schedule {
+		fake.Advance(step.advance)
+		waitFor(t, "the attempt to finish", func() bool { return handshake.Load() == step.handshakes })
+		settle(t, fake, 1)
+		if got := c.State(); got != StateReconnecting {
+			t.Fatalf("state at %v = %s, want reconnecting", fake.Since(epoch), got)
+		}
+	}
+
+	down.Store(false)
+	fake.Advance(time.Minute)
+	waitFor(t, "the third attempt at 180s to identify", func() bool { return c.State() == StateIdentified })
+	if handshake.Load() != 4 {
+		t.Errorf("%d handshakes, want 4", handshake.Load())
+	}
+}
+
+func TestHeartbeatFollowsClock(t *testing.T) {
+	srv := startServer(t, mockserver.Options{})
+	c, fake := newFakeClockClient(t, wsURL(srv), func(*config.WebSocketConfig) {})
+
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	go c.Listen(func(types.Response) {})
+	c.StartHeartbeat(30 * time.Second)
+	settle(t, fake, 1)
+
+	fake.Advance(29 * time.Second)
+	// Give a wrongly early ping the time to come back.
+	time.Sleep(20 * time.Millisecond)
+	if n := c.RTT().Samples; n != 0 {
+		t.Fatalf("%d RTT samples before the first tick, want 0", n)
+	}
+
+	for want := 1; want <= 2; want++ {
+		fake.Advance(time.Second)
+		waitFor(t, "the pong", func() bool { return c.RTT().Samples == want })
+		settle(t, fake, 1)
+		fake.Advance(29 * time.Second)
+	}
+}
+
+func TestWriterFollowsRateWindow(t *testing.T) {
+	srv := startServer(t, mockserver.Options{})
+	c, fake := newFakeClockClient(t, wsURL(srv), func(cfg *config.WebSocketConfig) {
+		cfg.RateLimit.Enabled = true
+		cfg.RateLimit.Global = ratelimit.Rate{Limit: 2, Window: 30 * time.Second, Algorithm: ratelimit.AlgorithmSlidingWindow}
+		cfg.OutboundQueue.TTL = time.Hour
+	})
+
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	go c.Listen(func(types.Response) {})
+
+	var deliveries []*Delivery
+	for range 3 {
+		deliveries = append(deliveries, c.Send(chat("hello")))
+	}
+	for _, d := range deliveries[:2] {
+		if err := d.Wait(context.Background()); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+
+	// The third send's TTL timer and the writer's wait for the window.
+	settle(t, fake, 2)
+	fake.Advance(29 * time.Second)
+	settle(t, fake, 2)
+	if got := deliveries[2].Status(); got != Pending {
+		t.Fatalf("third send is %s after 29s, want pending", got)
+	}
+
+	fake.Advance(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := deliveries[2].Wait(ctx); err != nil {
+		t.Fatalf("third send after 30s: %v", err)
+	}
+}
+
+func TestEventsCarryClockTime(t *testing.T) {
+	srv := startServer(t, mockserver.Options{})
+	c, fake := newFakeClockClient(t, wsURL(srv), func(*config.WebSocketConfig) {})
+	fake.Advance(time.Hour)
+
+	states, stopStates := c.Subscribe()
+	defer stopStates()
+	identities, stopIdentities := c.SubscribeIdentity()
+	defer stopIdentities()
+
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	go c.Listen(func(types.Response) {})
+	c.RequestID()
+
+	want := epoch.Add(time.Hour)
+	for event := range states {
+		if !event.At.Equal(want) {
+			t.Fatalf("%s -> %s at %v, want %v", event.From, event.To, event.At, want)
+		}
+		if event.To == StateIdentified {
+			break
+		}
+	}
+	select {
+	case event := <-identities:
+		if !event.At.Equal(want) {
+			t.Fatalf("identified at %v, want %v", event.At, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no identity event")
+	}
+}
@@ -0,0 +1,30 @@
+package connection
+
+import (
+	"context"
+	"hiurachat/internal/types"
+)
+
+// Transport is everything the bot needs from a link to a chat server. Client
+// implements it over a WebSocket and Pipe implements it in memory.
+type Transport interface {
+	Connect() error
+	Listen(handler func(types.Response))
+	Send(msg types.Message) *Delivery
+	SendWithPriority(msg types.Message, priority Priority) *Delivery
+	SendContext(ctx context.Context, msg types.Message, priority Priority) *Delivery
+	Request(ctx context.Context, msg types.Message) (types.Response, error)
+	Close(ctx context.Context) error
+	State() State
+	Subscribe() (<-chan StateEvent, func())
+	Identity() Identity
+	SubscribeIdentity() (<-chan IdentityEvent, func())
+	// UnderPressure reports whether sends are being held back by rate
+	// limiting.
+	UnderPressure() bool
+}
+
+var (
+	_ Transport = (*Client)(nil)
+	_ Transport = (*Pipe)(nil)
+)
@@ -1,8 +0,0 @@
-package connection
-
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
@@ -4,68 +4,187 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"hiurachat/internal/ratelimit"
 	"hiurachat/internal/types"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
-func (c *Client) WriteJSON(v interface{}) error {
-	if !c.isConnected {
-		return fmt.Errorf("not connected")
-	}
+// Send queues msg on the interactive lane.
+func (c *Client) Send(msg types.Message) *Delivery {
+	return c.SendWithPriority(msg, PriorityInteractive)
+}
+
+// SendWithPriority queues msg for the writer goroutine. Messages stay queued
+// across reconnects until they are written, expire or get dropped.
+func (c *Client) SendWithPriority(msg types.Message, priority Priority) *Delivery {
+	return c.SendContext(context.Background(), msg, priority)
+}
+
+// SendContext is SendWithPriority for a caller that may stop caring: if ctx
+// ends while msg is still queued, for example waiting on the rate limiter,
+// msg is dropped instead of being written late.
+func (c *Client) SendContext(ctx context.Context, msg types.Message, priority Priority) *Delivery {
+	d := newDelivery()
 
-	payload, err := json.Marshal(v)
+	payload, err := json.Marshal(msg)
 	if err != nil {
-		return fmt.Errorf("failed to marshal JSON: %w", err)
+		d.resolve(Dropped, fmt.Errorf("failed to marshal JSON: %w", err))
+		return d
 	}
-
-	if c.middleware == nil {
-		return c.performWrite(v, payload)
+	if err := ctx.Err(); err != nil {
+		d.resolve(Dropped, fmt.Errorf("send cancelled: %w", err))
+		return d
 	}
 
-	var route string
-	if msg, ok := v.(types.Message); ok {
-		route = msg.Action
-	} else {
+	route := msg.Action
+	if route == "" {
 		route = "default"
 	}
 
-	err = c.middleware.Handle(context.Background(), route, func() error {
-		return c.performWrite(v, payload)
+	queued := &queuedMessage{
+		route:     route,
+		target:    msg.Target,
+		frameType: websocket.TextMessage,
+		payload:   payload,
+		priority:  priority,
+		ttl:       c.config.OutboundQueue.TTL,
+		delivery:  d,
+		ctx:       ctx,
+	}
+	c.queue.push(queued)
+	return d
+}
+
+// sendControl queues a WebSocket control frame on its own lane, ahead of
+// requests and chat traffic. Control frames are not rate limited and are
+// only useful for a short while.
+func (c *Client) sendControl(frameType int, data []byte) *Delivery {
+	d := newDelivery()
+	c.queue.push(&queuedMessage{
+		frameType: frameType,
+		payload:   data,
+		priority:  priorityFrame,
+		ttl:       c.config.WriteTimeout,
+		delivery:  d,
 	})
+	return d
+}
 
-	if err != nil {
-		if rateLimitErr, ok := err.(*ratelimit.RateLimitError); ok {
-			c.logger.Debug("Rate limited on route %s, retry after %v", rateLimitErr.Route, rateLimitErr.RetryAfter)
-			time.Sleep(rateLimitErr.RetryAfter)
-			return c.WriteJSON(v)
+func (c *Client) writeLoop() {
+	defer c.wg.Done()
+
+	timer := c.clock.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		wait := c.drainQueue()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
+			}
+		}
+		if wait > 0 {
+			timer.Reset(wait)
+		}
+
+		select {
+		case <-c.done:
+			return
+		case <-c.queue.wake:
+		case <-timer.C():
 		}
-		return err
 	}
+}
 
-	return nil
+// drainQueue writes queued frames for as long as the rate limiter allows and
+// returns how long to wait before the next frame becomes eligible.
+func (c *Client) drainQueue() time.Duration {
+	for {
+		sess := c.current()
+		if !c.writable(sess) {
+			return 0
+		}
+
+		msg, wait := c.queue.next(c.acquire)
+		if msg == nil {
+			return wait
+		}
+
+		if err := c.writeFrame(sess, msg); err != nil {
+			if msg.frameType == websocket.PingMessage || msg.frameType == websocket.PongMessage {
+				// Pings and pongs belong to the session that just failed.
+				msg.delivery.resolve(Dropped, err)
+			} else {
+				c.queue.requeue(msg)
+			}
+			return 0
+		}
+
+		msg.delivery.resolve(Delivered, nil)
+		if msg.held {
+			c.rateLimiter.CountWait(msg.route)
+		}
+	}
 }
 
-func (c *Client) performWrite(v interface{}, payload []byte) error {
-	c.writeMu.Lock()
-	defer c.writeMu.Unlock()
+func (c *Client) acquire(msg *queuedMessage) (time.Duration, bool) {
+	if msg.frameType != websocket.TextMessage || c.rateLimiter == nil {
+		return 0, true
+	}
 
-	c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
-	c.logger.Debug("Payload: %s", string(payload))
+	waitTime, allowed := c.rateLimiter.TryAcquireTarget(msg.route, msg.target)
+	if !allowed {
+		msg.held = true
+		c.logger.Debug("Rate limited on route %s (target %q), retry after %v", msg.route, msg.target, waitTime)
+	}
+	return waitTime, allowed
+}
 
-	if err := c.conn.WriteJSON(v); err != nil {
-		c.logger.Error("failed to write JSON: %v", err)
-		c.handleDisconnect()
+// discarded counts a message the rate limiter held back and that never went
+// out as a denial.
+func (c *Client) discarded(msg *queuedMessage) {
+	if msg.held {
+		c.rateLimiter.CountDenial(msg.route)
+	}
+}
+
+func (c *Client) writeFrame(sess *session, msg *queuedMessage) error {
+	deadline := time.Now().Add(c.config.WriteTimeout)
+
+	var err error
+	if msg.frameType == websocket.TextMessage {
+		c.logger.Debug("Payload: %s", string(msg.payload))
+		sess.conn.SetWriteDeadline(deadline)
+		err = sess.conn.WriteMessage(websocket.TextMessage, msg.payload)
+	} else {
+		err = sess.conn.WriteControl(msg.frameType, msg.payload, deadline)
+	}
+
+	if err != nil {
+		c.logger.Error("failed to write frame: %v", err)
+		c.handleDisconnect(sess, err)
 		return fmt.Errorf("failed to write to websocket: %w", err)
 	}
 
-	c.lastWrite = time.Now()
+	if c.recorder != nil && msg.frameType == websocket.TextMessage {
+		c.recorder.outbound(msg.payload)
+	}
+
+	c.mu.Lock()
+	c.lastWrite = c.clock.Now()
+	c.mu.Unlock()
 	return nil
 }
 
-func (c *Client) WriteControl(messageType int, data []byte, deadline time.Time) error {
-	c.writeMu.Lock()
-	defer c.writeMu.Unlock()
+func (c *Client) connected() bool {
+	return c.state.is(StateConnected, StateIdentified)
+}
 
-	return c.conn.WriteControl(messageType, data, deadline)
+// writable also covers the closing handshake, during which the socket is
+// still up until the monitor goroutine sees the server's close frame.
+func (c *Client) writable(sess *session) bool {
+	return sess != nil && sess.alive() && c.state.is(StateConnected, StateIdentified, StateClosing)
 }
@@ -1,37 +1,111 @@
 package handler
 
 import (
-	"fmt"
+	"context"
+	"hiurachat/internal/clock"
+	"hiurachat/internal/config"
 	"hiurachat/internal/connection"
 	"hiurachat/internal/logger"
 	"hiurachat/internal/types"
 	"strings"
-	"time"
+	"sync"
 )
 
 type MessageHandler struct {
 	logger         *logger.Logger
 	prefix         string
 	responsePrefix string
-	conn           *connection.Client
+	conn           connection.Transport
 	commands       map[string]types.Command
-	bot            types.Latency
+	mu             sync.Mutex
+	stopped        bool
+	inflight       sync.WaitGroup
+	events         *types.EventRegistry
+	listeners      map[string][]func(types.Event)
+	admins         map[string]bool
+	throttle       *throttle
+	messages       config.MessagesConfig
+	coalescer      *coalescer
+	clock          clock.Clock
 }
 
-func New(logger *logger.Logger, prefix string, rprefix string, bot types.Latency) *MessageHandler {
+func New(logger *logger.Logger, prefix string, rprefix string) *MessageHandler {
 	return &MessageHandler{
 		logger:         logger,
 		prefix:         prefix,
 		responsePrefix: rprefix,
 		commands:       make(map[string]types.Command),
-		bot:            bot,
+		events:         types.DefaultEvents,
+		listeners:      make(map[string][]func(types.Event)),
+		clock:          clock.Real,
 	}
 }
 
+// On registers fn for every inbound event of type typ, such as
+// types.EventJoin or a type registered on types.DefaultEvents. It runs on the
+// listen loop, so it must not block. Register listeners before Listen.
+func (h *MessageHandler) On(typ string, fn func(types.Event)) {
+	h.listeners[typ] = append(h.listeners[typ], fn)
+}
+
 func (h *MessageHandler) SetCommands(commands map[string]types.Command) {
 	h.commands = commands
 }
 
+// SetAdmins sets who may run admin-only commands, by connection ID. Display
+// names are never matched: the client picks its own, so anyone could take
+// an admin's name.
+func (h *MessageHandler) SetAdmins(admins []string) {
+	h.admins = make(map[string]bool, len(admins))
+	for _, admin := range admins {
+		h.admins[admin] = true
+	}
+}
+
+func (h *MessageHandler) IsAdmin(msg types.ChatMessage) bool {
+	return msg.Sender != "" && h.admins[msg.Sender]
+}
+
+// SetClock makes command cooldowns and the coalescing window follow c. It
+// must be called before the handler is used.
+func (h *MessageHandler) SetClock(c clock.Clock) {
+	h.clock = c
+	if h.coalescer != nil {
+		h.coalescer.clock = c
+	}
+}
+
+// SetThrottle applies per-user command cooldowns. Commands that arrive
+// during a cooldown are dropped.
+func (h *MessageHandler) SetThrottle(cfg config.ThrottleConfig) error {
+	throttle, err := newThrottle(cfg)
+	if err != nil {
+		return err
+	}
+	h.throttle = throttle
+	return nil
+}
+
+// SetMessages sets how long messages are split and whether short replies
+// are coalesced while sends are rate limited.
+func (h *MessageHandler) SetMessages(cfg config.MessagesConfig) {
+	h.messages = cfg
+	h.coalescer = nil
+	if cfg.CoalesceWindow > 0 {
+		h.coalescer = newCoalescer(cfg.CoalesceWindow, cfg.MaxLength, h.clock, func(target, message string) []*connection.Delivery {
+			return h.queueParts(target, message, connection.PriorityInteractive)
+		})
+	}
+}
+
+// ThrottleStats reports how many commands per-user throttling has dropped.
+func (h *MessageHandler) ThrottleStats() ThrottleStats {
+	if h.throttle == nil {
+		return ThrottleStats{}
+	}
+	return h.throttle.stats()
+}
+
 func (h *MessageHandler) GetPrefix() string {
 	return h.prefix
 }
@@ -40,69 +114,211 @@ func (h *MessageHandler) GetResponsePrefix() string {
 	return h.responsePrefix
 }
 
-func (h *MessageHandler) HandleCommand(commandStr string, args []string) (string, bool) {
+// Stop makes the handler ignore any command received from now on.
+func (h *MessageHandler) Stop() {
+	h.mu.Lock()
+	h.stopped = true
+	h.mu.Unlock()
+}
+
+// Drain waits for commands that were already executing when Stop was called.
+func (h *MessageHandler) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Go runs fn in the background as part of the current command, so Drain
+// waits for it. It reports false if the handler is already stopping.
+func (h *MessageHandler) Go(fn func()) bool {
+	if !h.acquire() {
+		return false
+	}
+
+	go func() {
+		defer h.inflight.Done()
+		fn()
+	}()
+	return true
+}
+
+func (h *MessageHandler) acquire() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.stopped {
+		return false
+	}
+	h.inflight.Add(1)
+	return true
+}
+
+func (h *MessageHandler) HandleCommand(msg types.ChatMessage, commandStr string, args []string) (string, bool) {
 	commandName := strings.TrimPrefix(commandStr, h.prefix)
 
 	command, exists := h.commands[commandName]
 	if !exists {
 		return "", false
 	}
+	admin := h.IsAdmin(msg)
+	if command.AdminOnly && !admin {
+		h.logger.Warn("Ignoring %s from %s (%s), who is not an admin", commandStr, msg.SenderName, msg.Sender)
+		return "", false
+	}
+
+	if h.throttle != nil && !admin {
+		if wait, notice := h.throttle.allow(msg, commandName, h.clock.Now()); wait > 0 {
+			h.logger.Info("Throttled %s from %s for another %v", commandStr, msg.SenderName, wait)
+			if notice != "" {
+				return h.responsePrefix + " " + notice, true
+			}
+			return "", false
+		}
+	}
 
 	return command.Execute(args)
 }
 
-func (h *MessageHandler) Listen(conn *connection.Client) {
+func (h *MessageHandler) Listen(conn connection.Transport) {
 	h.conn = conn
 
 	messageHandler := func(response types.Response) {
-		if response.ConnectionId != "" {
-			if conn.GetBotID() == "" {
-				conn.SetBotID(response.ConnectionId)
-				h.logger.Info("Connected as: %s (%s)", response.Name, conn.GetBotID())
-			}
+		event := h.events.Decode(response)
 
-			lat := h.bot.GetLatency()
-			if !lat.IsZero() {
-				latency := time.Since(lat)
-				h.bot.SetLatency(time.Time{})
-				err := h.SendMessage(h.GetResponsePrefix() +
-					fmt.Sprintf(" Pong! (Latency: %.2fms)", float64(latency.Microseconds())/1000.0))
-				if err != nil {
-					h.logger.Error("Failed to send ping response: %s", err)
-				}
+		switch ev := event.(type) {
+		case types.ChatMessage:
+			h.handleChat(ev, conn)
+		case types.SystemNotice:
+			h.logger.Info("[system] %s", ev.Message)
+		case types.Presence:
+			if ev.Joined() {
+				h.logger.Info("%s joined", ev.Name)
+			} else {
+				h.logger.Info("%s left", ev.Name)
 			}
-			return
+		case types.UnknownEvent:
+			h.logger.Debug("Unhandled %q frame", response.Type)
 		}
 
-		if response.Message == "" || response.Sender == conn.GetBotID() {
-			return
+		for _, fn := range h.listeners[event.EventType()] {
+			fn(event)
 		}
+	}
+
+	conn.Listen(messageHandler)
+}
+
+func (h *MessageHandler) handleChat(msg types.ChatMessage, conn connection.Transport) {
+	if msg.Sender == conn.Identity().ID {
+		return
+	}
+
+	parts := strings.Fields(msg.Message)
+	if len(parts) > 0 {
+		command := parts[0]
+		args := parts[1:]
 
-		parts := strings.Fields(response.Message)
-		if len(parts) > 0 {
-			command := parts[0]
-			args := parts[1:]
-
-			if strings.HasPrefix(command, h.prefix) {
-				if response, ok := h.HandleCommand(command, args); ok {
-					if err := h.SendMessage(response); err != nil {
-						h.logger.Error("Failed to send message: %v", err)
-					}
-				}
+		if strings.HasPrefix(command, h.prefix) && h.acquire() {
+			if response, ok := h.HandleCommand(msg, command, args); ok {
+				h.reply(response)
 			}
+			h.inflight.Done()
 		}
-		h.logger.Info("%s: %s", response.SenderName, response.Message)
 	}
-
-	conn.Listen(messageHandler)
+	h.logger.Info("%s: %s", msg.SenderName, msg.Message)
 }
 
+// SendMessage sends message to the room, split into parts if it is too long.
+// While the rate limiter is holding sends back, a short message may wait for
+// the coalescing window and go out together with other replies.
 func (h *MessageHandler) SendMessage(message string) error {
-	msg := types.Message{
+	if b := h.coalesce(message); b != nil {
+		return b.wait(context.Background())
+	}
+	return h.send(message)
+}
+
+// reply queues a command's response without waiting for it to be written,
+// so a rate limited reply never holds up the listen loop. The outcome is
+// logged in the background, and Drain waits for it.
+func (h *MessageHandler) reply(message string) {
+	var wait func(context.Context) error
+	if b := h.coalesce(message); b != nil {
+		wait = b.wait
+	} else {
+		deliveries := h.queueParts(roomTarget, message, connection.PriorityInteractive)
+		wait = func(ctx context.Context) error { return waitAll(ctx, deliveries) }
+	}
+
+	h.Go(func() {
+		if err := wait(context.Background()); err != nil {
+			h.logger.Error("Failed to send message: %v", err)
+		}
+	})
+}
+
+// coalesce hands message to the coalescer, which starts a batch while the
+// rate limiter is under pressure, and returns nil when message should be
+// sent on its own.
+func (h *MessageHandler) coalesce(message string) *batch {
+	if h.coalescer == nil {
+		return nil
+	}
+	return h.coalescer.add(roomTarget, message, h.conn.UnderPressure())
+}
+
+// Announce sends message on the bulk lane so it never delays command replies.
+func (h *MessageHandler) Announce(message string) error {
+	return h.sendParts(message, connection.PriorityBulk)
+}
+
+func (h *MessageHandler) send(message string) error {
+	return h.sendParts(message, connection.PriorityInteractive)
+}
+
+func (h *MessageHandler) sendParts(message string, priority connection.Priority) error {
+	return waitAll(context.Background(), h.queueParts(roomTarget, message, priority))
+}
+
+// queueParts queues every part of message to target at once, so the parts
+// go out back to back and in order.
+func (h *MessageHandler) queueParts(target, message string, priority connection.Priority) []*connection.Delivery {
+	var deliveries []*connection.Delivery
+	for _, part := range splitMessage(message, h.messages.MaxLength, h.messages.Continuation) {
+		msg := chatMessage(part)
+		msg.Target = target
+		deliveries = append(deliveries, h.conn.SendWithPriority(msg, priority))
+	}
+	return deliveries
+}
+
+func waitAll(ctx context.Context, deliveries []*connection.Delivery) error {
+	for _, d := range deliveries {
+		if err := d.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// roomTarget is the target of everything the handler sends. Chat has a
+// single room, so all replies share one coalescing batch.
+const roomTarget = ""
+
+func chatMessage(message string) types.Message {
+	return types.Message{
 		Action: "sendMessage",
 		Data: &types.MessageData{
 			Message: message,
 		},
 	}
-	return h.conn.WriteJSON(msg)
 }
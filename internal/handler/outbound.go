@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"context"
+	"hiurachat/internal/clock"
+	"hiurachat/internal/connection"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// splitMessage breaks message into parts of at most maxLen runes, preferring
+// to break at whitespace and only cutting a word that is longer than a whole
+// part. Every part but the last ends with marker. A maxLen of zero or less
+// means no limit.
+func splitMessage(message string, maxLen int, marker string) []string {
+	if maxLen <= 0 || utf8.RuneCountInString(message) <= maxLen {
+		return []string{message}
+	}
+
+	budget := maxLen - utf8.RuneCountInString(marker)
+	if budget <= 0 {
+		budget, marker = maxLen, ""
+	}
+
+	var parts []string
+	rest := []rune(message)
+	for len(rest) > maxLen {
+		cut := budget
+		for i := budget; i > 0; i-- {
+			if unicode.IsSpace(rest[i]) {
+				cut = i
+				break
+			}
+		}
+
+		part := strings.TrimRightFunc(string(rest[:cut]), unicode.IsSpace)
+		if part == "" {
+			part, cut = string(rest[:budget]), budget
+		}
+		parts = append(parts, part+marker)
+		rest = []rune(strings.TrimLeftFunc(string(rest[cut:]), unicode.IsSpace))
+	}
+	if len(rest) > 0 {
+		parts = append(parts, string(rest))
+	}
+	return parts
+}
+
+// coalescer holds short replies for a window and sends them as one message,
+// so a burst of replies costs one rate limit token instead of one each.
+// Replies are batched per target. While a target has a batch pending, every
+// message to it goes through the coalescer, so none overtakes the batch.
+type coalescer struct {
+	mu      sync.Mutex
+	window  time.Duration
+	maxLen  int
+	clock   clock.Clock
+	queue   func(target, message string) []*connection.Delivery
+	batches map[string]*batch
+}
+
+// batch is a group of replies that is queued as one message. A message that
+// was queued on its own is returned as a batch that has already gone.
+type batch struct {
+	target     string
+	parts      []string
+	size       int
+	timer      clock.Timer
+	queued     chan struct{}
+	deliveries []*connection.Delivery
+}
+
+// separator joins coalesced replies.
+const separator = "\n"
+
+func newCoalescer(window time.Duration, maxLen int, clk clock.Clock, queue func(target, message string) []*connection.Delivery) *coalescer {
+	return &coalescer{
+		window:  window,
+		maxLen:  maxLen,
+		clock:   clk,
+		queue:   queue,
+		batches: make(map[string]*batch),
+	}
+}
+
+// add hands message for target to the coalescer. Without a batch pending for
+// target it starts one if start is set and otherwise returns nil, leaving
+// the caller to send message itself. A message too long to join a batch, or
+// that would push it past maxLen, sends the pending batch at once; a long
+// one is then queued right behind it and a short one starts a new batch.
+func (c *coalescer) add(target, message string, start bool) *batch {
+	size := utf8.RuneCountInString(message)
+	long := c.maxLen > 0 && size > c.maxLen
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := c.batches[target]
+	if b == nil && (!start || long) {
+		return nil
+	}
+	if b != nil && (long || c.maxLen > 0 && b.size+len(separator)+size > c.maxLen) {
+		c.flush(b)
+		if long {
+			return c.alone(target, message)
+		}
+		b = nil
+	}
+	if b == nil {
+		b = &batch{target: target, queued: make(chan struct{}), size: -len(separator)}
+		b.timer = c.clock.AfterFunc(c.window, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			if c.batches[target] == b {
+				c.flush(b)
+			}
+		})
+		c.batches[target] = b
+	}
+	b.parts = append(b.parts, message)
+	b.size += len(separator) + size
+	return b
+}
+
+// flush queues b as one message. Must be called with c.mu held.
+func (c *coalescer) flush(b *batch) {
+	b.timer.Stop()
+	delete(c.batches, b.target)
+	b.deliveries = c.queue(b.target, strings.Join(b.parts, separator))
+	close(b.queued)
+}
+
+// alone queues message on its own. Must be called with c.mu held.
+func (c *coalescer) alone(target, message string) *batch {
+	b := &batch{target: target, queued: make(chan struct{})}
+	b.deliveries = c.queue(target, message)
+	close(b.queued)
+	return b
+}
+
+// wait blocks until the batch has been written and returns the first error.
+func (b *batch) wait(ctx context.Context) error {
+	select {
+	case <-b.queued:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return waitAll(ctx, b.deliveries)
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"context"
+	"hiurachat/internal/clock"
+	"hiurachat/internal/config"
+	"hiurachat/internal/connection"
+	"hiurachat/internal/types"
+	"testing"
+	"time"
+)
+
+// sent is one chat message that came out of the pipe.
+type sent struct {
+	target  string
+	message string
+}
+
+func newPipe(t *testing.T) (*connection.Pipe, *connection.PipePeer) {
+	t.Helper()
+
+	pipe, peer := connection.NewPipe(16)
+	if err := pipe.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pipe.Close(context.Background()) })
+	return pipe, peer
+}
+
+func decode(t *testing.T, msg types.Message) sent {
+	t.Helper()
+
+	var data types.MessageData
+	if err := msg.DecodeData(&data); err != nil {
+		t.Fatal(err)
+	}
+	return sent{msg.Target, data.Message}
+}
+
+// expect fails unless want are the next messages the peer receives.
+func expect(t *testing.T, peer *connection.PipePeer, want ...sent) {
+	t.Helper()
+
+	for _, w := range want {
+		select {
+		case msg := <-peer.Outbound():
+			if got := decode(t, msg); got != w {
+				t.Fatalf("sent %+v, want %+v", got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%+v was never sent", w)
+		}
+	}
+}
+
+// expectNone fails if the peer receives anything.
+func expectNone(t *testing.T, peer *connection.PipePeer) {
+	t.Helper()
+
+	select {
+	case msg := <-peer.Outbound():
+		t.Fatalf("sent %+v early", msg)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func newTestCoalescer(pipe *connection.Pipe, fake *clock.Fake, window time.Duration, maxLen int) *coalescer {
+	return newCoalescer(window, maxLen, fake, func(target, message string) []*connection.Delivery {
+		msg := chatMessage(message)
+		msg.Target = target
+		return []*connection.Delivery{pipe.Send(msg)}
+	})
+}
+
+func TestCoalescerWindow(t *testing.T) {
+	pipe, peer := newPipe(t)
+	fake := clock.NewFake(epoch)
+	c := newTestCoalescer(pipe, fake, 2*time.Second, 0)
+
+	first := c.add("", "one", true)
+	c.add("", "two", false)
+	fake.Advance(time.Second)
+	c.add("", "three", false)
+
+	fake.Advance(999 * time.Millisecond)
+	expectNone(t, peer)
+
+	fake.Advance(time.Millisecond)
+	expect(t, peer, sent{"", "one\ntwo\nthree"})
+	if err := first.wait(context.Background()); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+
+	// With the batch gone, nothing joins one unless asked to start it.
+	if b := c.add("", "four", false); b != nil {
+		t.Fatal("add started a batch without start")
+	}
+}
+
+func TestCoalescerBatchesPerTarget(t *testing.T) {
+	pipe, peer := newPipe(t)
+	fake := clock.NewFake(epoch)
+	c := newTestCoalescer(pipe, fake, time.Second, 0)
+
+	c.add("alice", "one", true)
+	c.add("bob", "two", true)
+	c.add("alice", "three", false)
+	// No batch is pending for carol, so this one is the caller's to send.
+	if b := c.add("carol", "four", false); b != nil {
+		t.Fatal("a message to carol joined another target's batch")
+	}
+
+	fake.Advance(time.Second)
+	got := map[string]string{}
+	for range 2 {
+		s := decode(t, <-peer.Outbound())
+		got[s.target] = s.message
+	}
+	if got["alice"] != "one\nthree" || got["bob"] != "two" {
+		t.Fatalf("sent %q, want alice's and bob's replies batched apart", got)
+	}
+}
+
+func TestCoalescerFlushesFullBatch(t *testing.T) {
+	pipe, peer := newPipe(t)
+	fake := clock.NewFake(epoch)
+	c := newTestCoalescer(pipe, fake, time.Second, 10)
+
+	c.add("", "hello", true)
+	// "hello\nworld" is 11 runes, so the first batch goes at once.
+	c.add("", "world", false)
+	expect(t, peer, sent{"", "hello"})
+
+	fake.Advance(time.Second)
+	expect(t, peer, sent{"", "world"})
+}
+
+func TestCoalescerLongMessageFollowsBatch(t *testing.T) {
+	pipe, peer := newPipe(t)
+	fake := clock.NewFake(epoch)
+	c := newTestCoalescer(pipe, fake, time.Second, 10)
+
+	if b := c.add("", "far too long to join", true); b != nil {
+		t.Fatal("a long message started a batch")
+	}
+
+	c.add("", "hi", true)
+	long := c.add("", "far too long to join", false)
+	if long == nil {
+		t.Fatal("a long message was left to overtake the pending batch")
+	}
+	expect(t, peer, sent{"", "hi"}, sent{"", "far too long to join"})
+	if err := long.wait(context.Background()); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if fake.Waiters() != 0 {
+		t.Error("the flushed batch's timer is still pending")
+	}
+}
+
+// pressured is a pipe whose sends are always being held back.
+type pressured struct {
+	*connection.Pipe
+}
+
+func (pressured) UnderPressure() bool { return true }
+
+func TestRepliesKeepOrderUnderPressure(t *testing.T) {
+	pipe, peer := newPipe(t)
+	fake := clock.NewFake(epoch)
+
+	h := New(testLogger(), "!", ">")
+	h.SetClock(fake)
+	h.SetMessages(config.MessagesConfig{MaxLength: 12, Continuation: "…", CoalesceWindow: time.Second})
+	h.conn = pressured{pipe}
+
+	long := "this reply is split in parts"
+	h.reply("one")
+	h.reply("two")
+	h.reply(long)
+
+	want := []sent{{"", "one\ntwo"}}
+	for _, part := range splitMessage(long, 12, "…") {
+		want = append(want, sent{"", part})
+	}
+	expect(t, peer, want...)
+
+	h.reply("three")
+	expectNone(t, peer)
+	fake.Advance(time.Second)
+	expect(t, peer, sent{"", "three"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.Drain(ctx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"fmt"
+	"hiurachat/internal/config"
+	"hiurachat/internal/types"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ThrottleStats counts the commands dropped by per-user throttling.
+type ThrottleStats struct {
+	Total int64
+	// Users maps each throttled user to how many of their commands were
+	// dropped.
+	Users map[string]int64
+}
+
+// Top returns up to n users with the most throttled commands.
+func (s ThrottleStats) Top(n int) []string {
+	users := make([]string, 0, len(s.Users))
+	for user := range s.Users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if s.Users[users[i]] != s.Users[users[j]] {
+			return s.Users[users[i]] > s.Users[users[j]]
+		}
+		return users[i] < users[j]
+	})
+	return users[:min(n, len(users))]
+}
+
+// throttle enforces per-user and per-command cooldowns on inbound commands.
+type throttle struct {
+	mu        sync.Mutex
+	cfg       config.ThrottleConfig
+	longest   time.Duration
+	last      map[string]time.Time
+	lastCmd   map[string]map[string]time.Time
+	noticed   map[string]bool
+	counts    map[string]int64
+	total     int64
+	lastPrune time.Time
+}
+
+func newThrottle(cfg config.ThrottleConfig) (*throttle, error) {
+	switch cfg.Key {
+	case "", "sender", "sender_name":
+	default:
+		return nil, fmt.Errorf("unknown throttle key %q", cfg.Key)
+	}
+
+	longest := cfg.PerUser
+	for _, cooldown := range cfg.Commands {
+		longest = max(longest, cooldown)
+	}
+
+	return &throttle{
+		cfg:     cfg,
+		longest: longest,
+		last:    make(map[string]time.Time),
+		lastCmd: make(map[string]map[string]time.Time),
+		noticed: make(map[string]bool),
+		counts:  make(map[string]int64),
+	}, nil
+}
+
+func (t *throttle) key(msg types.ChatMessage) string {
+	if t.cfg.Key == "sender_name" {
+		return msg.SenderName
+	}
+	return msg.Sender
+}
+
+// allow records command from msg's sender if no cooldown applies. Otherwise
+// it returns how long the sender must wait and the notice to send, which is
+// empty unless this is the first command throttled since their last one
+// went through.
+func (t *throttle) allow(msg types.ChatMessage, command string, now time.Time) (time.Duration, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(now)
+
+	key := t.key(msg)
+	var wait time.Duration
+	if last, ok := t.last[key]; ok {
+		wait = max(wait, last.Add(t.cfg.PerUser).Sub(now))
+	}
+	if last, ok := t.lastCmd[key][command]; ok {
+		wait = max(wait, last.Add(t.cfg.Commands[command]).Sub(now))
+	}
+
+	if wait <= 0 {
+		t.last[key] = now
+		if _, ok := t.cfg.Commands[command]; ok {
+			if t.lastCmd[key] == nil {
+				t.lastCmd[key] = make(map[string]time.Time)
+			}
+			t.lastCmd[key][command] = now
+		}
+		delete(t.noticed, key)
+		return 0, ""
+	}
+
+	t.total++
+	t.counts[key]++
+	if t.noticed[key] || t.cfg.Notice == "" {
+		return wait, ""
+	}
+	t.noticed[key] = true
+
+	left := max(wait.Round(time.Second), time.Second)
+	notice := strings.NewReplacer("{name}", msg.SenderName, "{wait}", left.String()).Replace(t.cfg.Notice)
+	return wait, notice
+}
+
+// prune forgets users whose cooldowns have all run out, at most once per
+// longest cooldown. Must be called with t.mu held.
+func (t *throttle) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < t.longest {
+		return
+	}
+	t.lastPrune = now
+
+	for key, last := range t.last {
+		if now.Sub(last) >= t.longest {
+			delete(t.last, key)
+			delete(t.lastCmd, key)
+			delete(t.noticed, key)
+		}
+	}
+}
+
+func (t *throttle) stats() ThrottleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	users := make(map[string]int64, len(t.counts))
+	for key, n := range t.counts {
+		users[key] = n
+	}
+	return ThrottleStats{Total: t.total, Users: users}
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"hiurachat/internal/clock"
+	"hiurachat/internal/config"
+	"hiurachat/internal/logger"
+	"hiurachat/internal/types"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func testLogger() *logger.Logger {
+	l := &logger.Logger{}
+	l.SetLogLevel(logger.ERROR + 1)
+	return l
+}
+
+func echo(args []string) (string, bool) { return "ok", true }
+
+func from(sender string) types.ChatMessage {
+	return types.ChatMessage{Sender: sender, SenderName: "user " + sender}
+}
+
+func TestThrottleCooldowns(t *testing.T) {
+	fake := clock.NewFake(epoch)
+	h := New(testLogger(), "!", ">")
+	h.SetClock(fake)
+	h.SetCommands(map[string]types.Command{
+		"ping": {Name: "ping", Execute: echo},
+		"roll": {Name: "roll", Execute: echo},
+	})
+	h.SetAdmins([]string{"admin"})
+	if err := h.SetThrottle(config.ThrottleConfig{
+		PerUser:  2 * time.Second,
+		Commands: map[string]time.Duration{"roll": 10 * time.Second},
+		Notice:   "{name}, wait {wait}",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		sender  string
+		command string
+		reply   string
+		ok      bool
+	}{
+		{"first command", 0, "a", "!roll", "ok", true},
+		{"inside the per-user cooldown", time.Second, "a", "!ping", "> user a, wait 1s", true},
+		{"notice only once", 0, "a", "!ping", "", false},
+		{"other users are not held back", 0, "b", "!roll", "ok", true},
+		{"admins are never throttled", 0, "admin", "!roll", "ok", true},
+		{"per-user cooldown over", time.Second, "a", "!ping", "ok", true},
+		{"command cooldown left after a command went through", 2 * time.Second, "a", "!roll", "> user a, wait 6s", true},
+		{"command cooldown over", 6 * time.Second, "a", "!roll", "ok", true},
+	}
+	for _, step := range steps {
+		fake.Advance(step.advance)
+		reply, ok := h.HandleCommand(from(step.sender), step.command, nil)
+		if reply != step.reply || ok != step.ok {
+			t.Errorf("%s: got %q, %t; want %q, %t", step.name, reply, ok, step.reply, step.ok)
+		}
+	}
+
+	stats := h.ThrottleStats()
+	if stats.Total != 3 || stats.Users["a"] != 3 {
+		t.Errorf("stats = %+v, want 3 commands throttled for a", stats)
+	}
+}
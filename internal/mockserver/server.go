@@ -0,0 +1,321 @@
+package mockserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hiurachat/internal/logger"
+	"hiurachat/internal/types"
+	mathrand "math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Faults makes the server misbehave on purpose. The zero value disables
+// every fault.
+type Faults struct {
+	DropRate       float64       // Chance of cutting a connection after each inbound frame
+	DropAfter      int           // Cut every connection after this many inbound frames
+	Delay          time.Duration // Added before every outbound frame
+	Throttle       int           // Inbound frames allowed per ThrottleWindow
+	ThrottleWindow time.Duration // Window for Throttle
+}
+
+type Options struct {
+	Faults     Faults
+	SendBuffer int
+	// CertFile and KeyFile switch the server to TLS (wss://).
+	CertFile string
+	KeyFile  string
+	// Token, when set, rejects handshakes without "Authorization: Bearer
+	// <Token>" with 401.
+	Token string
+}
+
+// Server speaks the same protocol as the HiuraChat server: getId is answered
+// with the caller's connectionId and name, and sendMessage is broadcast to
+// every connected client. Joins and leaves are announced as typed events.
+type Server struct {
+	logger   *logger.Logger
+	opts     Options
+	upgrader websocket.Upgrader
+	mu       sync.Mutex
+	clients  map[*client]struct{}
+	guests   int
+}
+
+type client struct {
+	id       string
+	name     string
+	conn     *websocket.Conn
+	send     chan []byte
+	received []time.Time
+	frames   int
+}
+
+func New(logger *logger.Logger, opts Options) *Server {
+	if opts.SendBuffer <= 0 {
+		opts.SendBuffer = 64
+	}
+
+	return &Server{
+		logger:  logger,
+		opts:    opts,
+		clients: make(map[*client]struct{}),
+	}
+}
+
+// ListenAndServe serves on addr until ctx is cancelled.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: s,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		if s.opts.CertFile != "" {
+			errc <- srv.ListenAndServeTLS(s.opts.CertFile, s.opts.KeyFile)
+			return
+		}
+		errc <- srv.ListenAndServe()
+	}()
+	s.logger.Info("Mock server listening on %s (TLS: %t)", addr, s.opts.CertFile != "")
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.closeAll()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.opts.Token {
+		s.logger.Warn("Rejected handshake from %s: missing or wrong token", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Error("Upgrade failed: %v", err)
+		return
+	}
+
+	c := s.register(conn, r.URL.Query().Get("name"))
+	s.broadcast(types.Response{Type: types.EventJoin, ConnectionId: c.id, Name: c.name})
+	defer func() {
+		s.unregister(c)
+		s.broadcast(types.Response{Type: types.EventLeave, ConnectionId: c.id, Name: c.name})
+	}()
+
+	go s.writeLoop(c)
+	s.readLoop(c)
+}
+
+func (s *Server) register(conn *websocket.Conn, name string) *client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if name == "" {
+		s.guests++
+		name = fmt.Sprintf("guest-%d", s.guests)
+	}
+
+	c := &client{
+		id:   newConnectionID(),
+		name: name,
+		conn: conn,
+		send: make(chan []byte, s.opts.SendBuffer),
+	}
+	s.clients[c] = struct{}{}
+	s.logger.Info("%s (%s) connected, %d clients", c.name, c.id, len(s.clients))
+	return c
+}
+
+func (s *Server) unregister(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.clients[c]; !ok {
+		return
+	}
+	delete(s.clients, c)
+	close(c.send)
+	c.conn.Close()
+	s.logger.Info("%s (%s) disconnected, %d clients", c.name, c.id, len(s.clients))
+}
+
+func (s *Server) closeAll() {
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		c.conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(time.Second),
+		)
+		s.unregister(c)
+	}
+}
+
+func (s *Server) readLoop(c *client) {
+	for {
+		var msg types.Message
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			s.logger.Debug("Read from %s ended: %v", c.id, err)
+			return
+		}
+
+		if s.injectFaults(c) {
+			return
+		}
+
+		switch msg.Action {
+		case "getId":
+			s.reply(c, types.Response{ConnectionId: c.id, Name: c.name})
+		case "sendMessage":
+			var data types.MessageData
+			if err := msg.DecodeData(&data); err != nil || data.Message == "" {
+				continue
+			}
+			s.logger.Info("%s: %s", c.name, data.Message)
+			s.broadcast(types.Response{
+				Message:    data.Message,
+				Sender:     c.id,
+				SenderName: c.name,
+			})
+		default:
+			s.logger.Warn("Unknown action %q from %s", msg.Action, c.id)
+		}
+	}
+}
+
+// injectFaults applies the configured faults after an inbound frame and
+// reports whether the connection was cut.
+func (s *Server) injectFaults(c *client) bool {
+	f := s.opts.Faults
+	c.frames++
+
+	if f.Throttle > 0 && f.ThrottleWindow > 0 {
+		now := time.Now()
+		cutoff := now.Add(-f.ThrottleWindow)
+		kept := c.received[:0]
+		for _, t := range c.received {
+			if t.After(cutoff) {
+				kept = append(kept, t)
+			}
+		}
+		c.received = append(kept, now)
+
+		if len(c.received) > f.Throttle {
+			s.logger.Warn("Throttling %s: %d frames in %v", c.id, len(c.received), f.ThrottleWindow)
+			c.conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater,
+					fmt.Sprintf("rate limited, retry after %s", f.ThrottleWindow)),
+				time.Now().Add(time.Second),
+			)
+			return true
+		}
+	}
+
+	if f.DropAfter > 0 && c.frames >= f.DropAfter {
+		s.logger.Warn("Dropping %s after %d frames", c.id, c.frames)
+		return true
+	}
+
+	if f.DropRate > 0 && mathrand.Float64() < f.DropRate {
+		s.logger.Warn("Randomly dropping %s", c.id)
+		return true
+	}
+
+	return false
+}
+
+func (s *Server) reply(c *client, resp types.Response) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		s.logger.Error("Failed to marshal response: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.enqueue(c, data)
+}
+
+func (s *Server) broadcast(resp types.Response) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		s.logger.Error("Failed to marshal response: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.clients {
+		s.enqueue(c, data)
+	}
+}
+
+// enqueue must be called with s.mu held so the channel cannot be closed
+// underneath it.
+func (s *Server) enqueue(c *client, data []byte) {
+	if _, ok := s.clients[c]; !ok {
+		return
+	}
+
+	select {
+	case c.send <- data:
+	default:
+		s.logger.Warn("Send buffer for %s full, dropping frame", c.id)
+	}
+}
+
+func (s *Server) writeLoop(c *client) {
+	for data := range c.send {
+		if s.opts.Faults.Delay > 0 {
+			time.Sleep(s.opts.Faults.Delay)
+		}
+
+		c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			s.logger.Debug("Write to %s failed: %v", c.id, err)
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+func newConnectionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,209 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// AdaptiveConfig tunes how the limiter learns from server throttling: each
+// throttle that follows a burst of sends multiplies every limiter's rate by
+// Decrease, and every IncreaseInterval without one adds Increase back until
+// the configured rate is reached again.
+type AdaptiveConfig struct {
+	Decrease         float64       `yaml:"decrease"`
+	MinFactor        float64       `yaml:"min_factor"`
+	Increase         float64       `yaml:"increase"`
+	IncreaseInterval time.Duration `yaml:"increase_interval"`
+	// A throttle only counts if at least BurstSends sends went out in the
+	// BurstWindow before it; otherwise it is blamed on something else.
+	BurstWindow time.Duration `yaml:"burst_window"`
+	BurstSends  int           `yaml:"burst_sends"`
+}
+
+// AdaptiveState is what the limiter has learned so far.
+type AdaptiveState struct {
+	Enabled bool
+	// Factor scales every configured rate, from MinFactor up to 1.
+	Factor float64
+	// Global is the global rate with Factor applied.
+	Global       Rate
+	Decreases    int
+	LastDecrease time.Time
+}
+
+type adaptive struct {
+	mu         sync.Mutex
+	cfg        AdaptiveConfig
+	factor     float64
+	lastChange time.Time
+	sends      []time.Time
+	decreases  int
+	lastDrop   time.Time
+	onAdjust   func(AdaptiveState)
+}
+
+// EnableAdaptive switches the limiter to adaptive mode. onAdjust, if not
+// nil, is called whenever the learned rate changes.
+func (rl *RateLimiter) EnableAdaptive(cfg AdaptiveConfig, onAdjust func(AdaptiveState)) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.adaptive = &adaptive{
+		cfg:        cfg,
+		factor:     1,
+		lastChange: rl.clock.Now(),
+		onAdjust:   onAdjust,
+	}
+}
+
+// Throttled tells the limiter the server pushed back, by disconnecting or
+// with a notice. It lowers the rate if the push back followed a burst of
+// sends and reports whether it did.
+func (rl *RateLimiter) Throttled() bool {
+	a := rl.adaptiveState()
+	if a == nil {
+		return false
+	}
+
+	now := rl.clock.Now()
+	a.mu.Lock()
+	recent := 0
+	for _, t := range a.sends {
+		if now.Sub(t) <= a.cfg.BurstWindow {
+			recent++
+		}
+	}
+	if recent < a.cfg.BurstSends || a.factor <= a.cfg.MinFactor {
+		a.mu.Unlock()
+		return false
+	}
+
+	a.factor = max(a.factor*a.cfg.Decrease, a.cfg.MinFactor)
+	a.lastChange = now
+	a.lastDrop = now
+	a.decreases++
+	a.sends = a.sends[:0]
+	state := rl.applyFactorLocked(a)
+	a.mu.Unlock()
+
+	a.report(state)
+	return true
+}
+
+// Adaptive returns the learned state. Enabled is false when the limiter is
+// not in adaptive mode.
+func (rl *RateLimiter) Adaptive() AdaptiveState {
+	a := rl.adaptiveState()
+	if a == nil {
+		return AdaptiveState{Factor: 1, Global: rl.defaultLimit}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return rl.stateLocked(a)
+}
+
+func (rl *RateLimiter) stateLocked(a *adaptive) AdaptiveState {
+	return AdaptiveState{
+		Enabled:      true,
+		Factor:       a.factor,
+		Global:       scaledRate(rl.defaultLimit, a.factor),
+		Decreases:    a.decreases,
+		LastDecrease: a.lastDrop,
+	}
+}
+
+func (rl *RateLimiter) adaptiveState() *adaptive {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+
+	return rl.adaptive
+}
+
+// recordSend notes a successful acquire for burst detection and applies any
+// additive increase that is due.
+func (rl *RateLimiter) recordSend(now time.Time) {
+	a := rl.adaptiveState()
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	kept := a.sends[:0]
+	for _, t := range a.sends {
+		if now.Sub(t) <= a.cfg.BurstWindow {
+			kept = append(kept, t)
+		}
+	}
+	a.sends = append(kept, now)
+	a.mu.Unlock()
+
+	rl.recover(now)
+}
+
+func (rl *RateLimiter) recover(now time.Time) {
+	a := rl.adaptiveState()
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	if a.factor >= 1 || a.cfg.IncreaseInterval <= 0 || now.Sub(a.lastChange) < a.cfg.IncreaseInterval {
+		a.mu.Unlock()
+		return
+	}
+
+	steps := float64(now.Sub(a.lastChange) / a.cfg.IncreaseInterval)
+	a.factor = min(a.factor+steps*a.cfg.Increase, 1)
+	a.lastChange = now
+	state := rl.applyFactorLocked(a)
+	a.mu.Unlock()
+
+	a.report(state)
+}
+
+// applyFactorLocked rescales every limiter to a.factor and returns the state
+// to report. Holding a.mu throughout means a decrease and a recovery racing
+// each other reach the limiters in the order they changed the factor.
+func (rl *RateLimiter) applyFactorLocked(a *adaptive) AdaptiveState {
+	rl.mu.RLock()
+	limiters := []Limiter{rl.globalLimiter}
+	for _, l := range rl.routeLimiters {
+		limiters = append(limiters, l)
+	}
+	for _, l := range rl.targetLimiters {
+		limiters = append(limiters, l)
+	}
+	now := rl.clock.Now()
+	rl.mu.RUnlock()
+
+	for _, l := range limiters {
+		l.Lock()
+		l.SetScale(now, a.factor)
+		l.Unlock()
+	}
+	return rl.stateLocked(a)
+}
+
+// report passes a change of the learned rate to onAdjust, if set.
+func (a *adaptive) report(state AdaptiveState) {
+	if a.onAdjust != nil {
+		a.onAdjust(state)
+	}
+}
+
+func (rl *RateLimiter) factor() float64 {
+	a := rl.adaptiveState()
+	if a == nil {
+		return 1
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.factor
+}
+
+// scaledBurst shrinks burst with the factor but never below one token.
+func scaledBurst(burst int, factor float64) int {
+	return max(int(float64(burst)*factor), 1)
+}
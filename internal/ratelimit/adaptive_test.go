@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"hiurachat/internal/clock"
+	"sync"
+	"testing"
+	"time"
+)
+
+var aimd = AdaptiveConfig{
+	Decrease:         0.5,
+	MinFactor:        0.25,
+	Increase:         0.25,
+	IncreaseInterval: 10 * time.Second,
+	BurstWindow:      10 * time.Second,
+	BurstSends:       2,
+}
+
+// globalRate is the rate the global limiter is actually running at.
+func globalRate(rl *RateLimiter) Rate {
+	rl.globalLimiter.Lock()
+	defer rl.globalLimiter.Unlock()
+
+	return rl.globalLimiter.Rate()
+}
+
+func TestAdaptiveDecreaseAndRecovery(t *testing.T) {
+	fake := clock.NewFake(epoch)
+	configured := Rate{Limit: 4, Window: time.Second, Burst: 4}
+	rl := NewRateLimiter(configured)
+	rl.SetClock(fake)
+
+	var adjusted []float64
+	rl.EnableAdaptive(aimd, func(s AdaptiveState) { adjusted = append(adjusted, s.Factor) })
+
+	if rl.Throttled() {
+		t.Fatal("a throttle without a burst of sends lowered the rate")
+	}
+
+	rl.TryAcquire("sendMessage")
+	rl.TryAcquire("sendMessage")
+	if !rl.Throttled() {
+		t.Fatal("a throttle after a burst did not lower the rate")
+	}
+	if rl.Throttled() {
+		t.Fatal("a second throttle lowered the rate again without a new burst")
+	}
+
+	steps := []struct {
+		advance time.Duration
+		factor  float64
+	}{
+		{0, 0.5},
+		{9 * time.Second, 0.5},
+		// One increase interval after the decrease.
+		{time.Second, 0.75},
+		// Two more intervals add two steps, capped at the configured rate.
+		{20 * time.Second, 1},
+	}
+	for _, step := range steps {
+		fake.Advance(step.advance)
+		rl.TryAcquire("sendMessage")
+
+		state := rl.Adaptive()
+		if state.Factor != step.factor {
+			t.Fatalf("factor %v after %v, want %v", state.Factor, fake.Since(epoch), step.factor)
+		}
+		if want := scaledRate(configured, step.factor); state.Global != want || globalRate(rl) != want {
+			t.Fatalf("global rate %+v (limiter %+v) at factor %v, want %+v", state.Global, globalRate(rl), step.factor, want)
+		}
+	}
+
+	want := []float64{0.5, 0.75, 1}
+	if len(adjusted) != len(want) {
+		t.Fatalf("onAdjust saw %v, want %v", adjusted, want)
+	}
+	for i := range want {
+		if adjusted[i] != want[i] {
+			t.Fatalf("onAdjust saw %v, want %v", adjusted, want)
+		}
+	}
+}
+
+func TestAdaptiveLimitersFollowFactor(t *testing.T) {
+	fake := clock.NewFake(epoch)
+	configured := Rate{Limit: 1000, Window: time.Second, Burst: 1000}
+	rl := NewRateLimiter(configured)
+	rl.SetClock(fake)
+	cfg := aimd
+	cfg.MinFactor = 0.01
+	rl.EnableAdaptive(cfg, nil)
+
+	// Decreases on one goroutine race recoveries on another, as they do
+	// between the monitor and the writer.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for range 200 {
+			rl.TryAcquire("sendMessage")
+			rl.TryAcquire("sendMessage")
+			rl.Throttled()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 200 {
+			fake.Advance(10 * time.Second)
+			rl.TryAcquire("sendMessage")
+		}
+	}()
+	wg.Wait()
+
+	if state := rl.Adaptive(); globalRate(rl) != state.Global {
+		t.Fatalf("global limiter runs at %+v, but the factor %v says %+v", globalRate(rl), state.Factor, state.Global)
+	}
+}
@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"math"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimitInfo is a snapshot of one route's limits. The global entry has an
+// empty Route and counts waits and denials across every route; a route entry
+// combines the global limiter with the route's own, so Remaining and
+// RetryAfter say when a send on that route could actually go out.
+type RateLimitInfo struct {
+	Route string
+	// Rate is the route's own rate, or the global rate if it has none,
+	// with any adaptive factor applied.
+	Rate       Rate
+	Remaining  int
+	Reset      time.Time     // When every limiter involved is at full capacity again
+	RetryAfter time.Duration // Until the next token, zero if one is available
+	Waits      int64         // Held back sends that went out later
+	Denials    int64         // Held back sends that were dropped, expired or cancelled
+}
+
+type routeCounters struct {
+	waits   atomic.Int64
+	denials atomic.Int64
+}
+
+// counters returns the counters for route, creating them on first use.
+func (rl *RateLimiter) counters(route string) *routeCounters {
+	rl.mu.RLock()
+	c, exists := rl.routeCounters[route]
+	rl.mu.RUnlock()
+	if exists {
+		return c
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if c, exists = rl.routeCounters[route]; !exists {
+		c = &routeCounters{}
+		rl.routeCounters[route] = c
+	}
+	return c
+}
+
+// CountWait records that a send on route which TryAcquire refused at first
+// has now been admitted.
+func (rl *RateLimiter) CountWait(route string) {
+	rl.counters(route).waits.Add(1)
+}
+
+// CountDenial records that a send on route which TryAcquire refused was
+// given up on instead of being admitted.
+func (rl *RateLimiter) CountDenial(route string) {
+	rl.counters(route).denials.Add(1)
+}
+
+// Info returns a snapshot of route's limits, or of the global limit when
+// route is empty.
+func (rl *RateLimiter) Info(route string) RateLimitInfo {
+	rl.mu.RLock()
+	limiters := []Limiter{rl.globalLimiter}
+	own := rl.globalLimiter
+	if limiter, exists := rl.routeLimiters[route]; exists && route != "" {
+		limiters = append(limiters, limiter)
+		own = limiter
+	}
+	counters := rl.routeCounters[route]
+	all := route == ""
+	var waits, denials int64
+	for _, c := range rl.routeCounters {
+		waits += c.waits.Load()
+		denials += c.denials.Load()
+	}
+	rl.mu.RUnlock()
+
+	info := inspect(limiters, rl.clock.Now())
+	info.Route = route
+
+	own.Lock()
+	info.Rate = own.Rate()
+	own.Unlock()
+
+	switch {
+	case all:
+		info.Waits, info.Denials = waits, denials
+	case counters != nil:
+		info.Waits, info.Denials = counters.waits.Load(), counters.denials.Load()
+	}
+	return info
+}
+
+// Snapshot returns the global entry followed by every route that has its
+// own limit or has had to wait or been denied, sorted by name.
+func (rl *RateLimiter) Snapshot() []RateLimitInfo {
+	rl.mu.RLock()
+	var routes []string
+	for route := range rl.routeLimiters {
+		routes = append(routes, route)
+	}
+	for route := range rl.routeCounters {
+		if _, exists := rl.routeLimiters[route]; !exists {
+			routes = append(routes, route)
+		}
+	}
+	rl.mu.RUnlock()
+
+	slices.Sort(routes)
+
+	infos := []RateLimitInfo{rl.Info("")}
+	for _, route := range routes {
+		infos = append(infos, rl.Info(route))
+	}
+	return infos
+}
+
+// inspect reports the state of limiters without counting a send.
+func inspect(limiters []Limiter, now time.Time) RateLimitInfo {
+	info := RateLimitInfo{Remaining: math.MaxInt, Reset: now}
+	for _, l := range limiters {
+		l.Lock()
+		state := l.State(now)
+		l.Unlock()
+
+		info.Remaining = min(info.Remaining, state.Remaining)
+		info.RetryAfter = max(info.RetryAfter, state.RetryAfter)
+		info.Reset = later(info.Reset, now.Add(state.Reset))
+	}
+	return info
+}
+
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,276 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Algorithm names how a Rate is enforced.
+type Algorithm string
+
+const (
+	// AlgorithmTokenBucket refills Limit tokens per Window up to Burst.
+	AlgorithmTokenBucket Algorithm = "token_bucket"
+	// AlgorithmSlidingWindow allows Limit sends in any Window long span,
+	// keeping a log of send times.
+	AlgorithmSlidingWindow Algorithm = "sliding_window"
+	// AlgorithmFixedWindow allows Limit sends per Window, with windows
+	// aligned to the clock so the count resets all at once.
+	AlgorithmFixedWindow Algorithm = "fixed_window"
+	// AlgorithmGCRA spaces sends Window/Limit apart, letting Burst of them
+	// through back to back. It behaves like a token bucket but keeps a
+	// single timestamp.
+	AlgorithmGCRA Algorithm = "gcra"
+)
+
+// Limiter is one rate limiting algorithm guarding one stream of sends.
+// Every method besides Lock and Unlock must be called with the limiter
+// locked, which lets RateLimiter admit a send on several limiters at once
+// or on none of them.
+type Limiter interface {
+	sync.Locker
+	// Delay returns how long from now until a send would be admitted, zero
+	// if it would be admitted now.
+	Delay(now time.Time) time.Duration
+	// Take counts a send at now. Callers check Delay first.
+	Take(now time.Time)
+	State(now time.Time) LimiterState
+	// Rate returns the configured rate with the current scale applied.
+	Rate() Rate
+	// SetScale multiplies the configured rate by scale, which adaptive
+	// rate limiting lowers after the server throttles the bot.
+	SetScale(now time.Time, scale float64)
+}
+
+// LimiterState is what a limiter would admit at the time it was taken.
+type LimiterState struct {
+	Remaining  int           // Sends admitted back to back from now
+	RetryAfter time.Duration // Until the next send is admitted
+	Reset      time.Duration // Until the limiter is back at full capacity
+}
+
+// NewLimiter returns the limiter for rate's algorithm. rate must pass
+// Validate.
+func NewLimiter(rate Rate) Limiter {
+	switch rate.Algorithm {
+	case AlgorithmSlidingWindow:
+		return NewSlidingWindow(rate)
+	case AlgorithmFixedWindow:
+		return NewFixedWindow(rate)
+	case AlgorithmGCRA:
+		return NewGCRA(rate)
+	}
+	return NewTokenBucket(rate)
+}
+
+// Validate reports settings the algorithm cannot enforce.
+func (r Rate) Validate() error {
+	if r.Limit <= 0 || r.Window <= 0 {
+		return fmt.Errorf("rate needs a positive limit and window, got %v per %v", r.Limit, r.Window)
+	}
+
+	switch r.Algorithm {
+	case "", AlgorithmTokenBucket, AlgorithmGCRA:
+		if r.Burst < 1 {
+			return fmt.Errorf("%s rate needs a burst of at least 1", r.algorithm())
+		}
+	case AlgorithmSlidingWindow, AlgorithmFixedWindow:
+		if r.Limit < 1 {
+			return fmt.Errorf("%s rate needs a limit of at least 1 per window", r.Algorithm)
+		}
+	default:
+		return fmt.Errorf("unknown rate limit algorithm %q", r.Algorithm)
+	}
+	return nil
+}
+
+func (r Rate) algorithm() Algorithm {
+	if r.Algorithm == "" {
+		return AlgorithmTokenBucket
+	}
+	return r.Algorithm
+}
+
+func scaledRate(rate Rate, scale float64) Rate {
+	rate.Limit *= scale
+	rate.Burst = scaledBurst(rate.Burst, scale)
+	return rate
+}
+
+// windowLimit is how many sends a window algorithm lets through per window.
+func windowLimit(rate Rate, scale float64) int {
+	return max(int(rate.Limit*scale), 1)
+}
+
+// SlidingWindow keeps the times of the sends in the last Window and admits
+// another only while there are fewer than Limit of them.
+type SlidingWindow struct {
+	mu    sync.Mutex
+	rate  Rate
+	scale float64
+	limit int
+	log   []time.Time
+}
+
+func NewSlidingWindow(rate Rate) *SlidingWindow {
+	return &SlidingWindow{rate: rate, scale: 1, limit: windowLimit(rate, 1)}
+}
+
+func (sw *SlidingWindow) Lock()   { sw.mu.Lock() }
+func (sw *SlidingWindow) Unlock() { sw.mu.Unlock() }
+
+// prune drops the sends that have left the window.
+func (sw *SlidingWindow) prune(now time.Time) {
+	i := 0
+	for i < len(sw.log) && !sw.log[i].Add(sw.rate.Window).After(now) {
+		i++
+	}
+	sw.log = sw.log[i:]
+}
+
+func (sw *SlidingWindow) Delay(now time.Time) time.Duration {
+	sw.prune(now)
+	if len(sw.log) < sw.limit {
+		return 0
+	}
+	return sw.log[len(sw.log)-sw.limit].Add(sw.rate.Window).Sub(now)
+}
+
+func (sw *SlidingWindow) Take(now time.Time) {
+	sw.log = append(sw.log, now)
+}
+
+func (sw *SlidingWindow) State(now time.Time) LimiterState {
+	state := LimiterState{RetryAfter: sw.Delay(now)}
+	state.Remaining = max(sw.limit-len(sw.log), 0)
+	if len(sw.log) > 0 {
+		state.Reset = sw.log[len(sw.log)-1].Add(sw.rate.Window).Sub(now)
+	}
+	return state
+}
+
+func (sw *SlidingWindow) Rate() Rate {
+	return scaledRate(sw.rate, sw.scale)
+}
+
+func (sw *SlidingWindow) SetScale(now time.Time, scale float64) {
+	sw.scale = scale
+	sw.limit = windowLimit(sw.rate, scale)
+}
+
+// FixedWindow counts sends per Window, with windows aligned to the clock,
+// and admits another only while the current window has fewer than Limit.
+type FixedWindow struct {
+	mu    sync.Mutex
+	rate  Rate
+	scale float64
+	limit int
+	start time.Time
+	count int
+}
+
+func NewFixedWindow(rate Rate) *FixedWindow {
+	return &FixedWindow{rate: rate, scale: 1, limit: windowLimit(rate, 1)}
+}
+
+func (fw *FixedWindow) Lock()   { fw.mu.Lock() }
+func (fw *FixedWindow) Unlock() { fw.mu.Unlock() }
+
+// roll starts a new window once now has left the current one.
+func (fw *FixedWindow) roll(now time.Time) {
+	if start := now.Truncate(fw.rate.Window); !start.Equal(fw.start) {
+		fw.start = start
+		fw.count = 0
+	}
+}
+
+func (fw *FixedWindow) Delay(now time.Time) time.Duration {
+	fw.roll(now)
+	if fw.count < fw.limit {
+		return 0
+	}
+	return fw.start.Add(fw.rate.Window).Sub(now)
+}
+
+func (fw *FixedWindow) Take(now time.Time) {
+	fw.roll(now)
+	fw.count++
+}
+
+func (fw *FixedWindow) State(now time.Time) LimiterState {
+	state := LimiterState{RetryAfter: fw.Delay(now)}
+	state.Remaining = max(fw.limit-fw.count, 0)
+	if fw.count > 0 {
+		state.Reset = fw.start.Add(fw.rate.Window).Sub(now)
+	}
+	return state
+}
+
+func (fw *FixedWindow) Rate() Rate {
+	return scaledRate(fw.rate, fw.scale)
+}
+
+func (fw *FixedWindow) SetScale(now time.Time, scale float64) {
+	fw.scale = scale
+	fw.limit = windowLimit(fw.rate, scale)
+}
+
+// GCRA is the generic cell rate algorithm. It tracks the theoretical arrival
+// time tat of the next send if sends were spaced exactly Window/Limit apart,
+// and admits a send as long as tat is no more than Burst-1 intervals ahead.
+type GCRA struct {
+	mu    sync.Mutex
+	rate  Rate
+	scale float64
+	tat   time.Time
+}
+
+func NewGCRA(rate Rate) *GCRA {
+	return &GCRA{rate: rate, scale: 1}
+}
+
+func (g *GCRA) Lock()   { g.mu.Lock() }
+func (g *GCRA) Unlock() { g.mu.Unlock() }
+
+func (g *GCRA) interval() time.Duration {
+	return time.Duration(float64(g.rate.Window) / (g.rate.Limit * g.scale))
+}
+
+// tolerance is how far ahead of now tat may be for a send to be admitted.
+func (g *GCRA) tolerance() time.Duration {
+	return time.Duration(scaledBurst(g.rate.Burst, g.scale)-1) * g.interval()
+}
+
+// ahead is how far tat lies past now, zero once it has been reached.
+func (g *GCRA) ahead(now time.Time) time.Duration {
+	if !g.tat.After(now) {
+		return 0
+	}
+	return g.tat.Sub(now)
+}
+
+func (g *GCRA) Delay(now time.Time) time.Duration {
+	return max(g.ahead(now)-g.tolerance(), 0)
+}
+
+func (g *GCRA) Take(now time.Time) {
+	g.tat = later(g.tat, now).Add(g.interval())
+}
+
+func (g *GCRA) State(now time.Time) LimiterState {
+	ahead := g.ahead(now)
+	return LimiterState{
+		Remaining:  max(int((g.tolerance()-ahead+g.interval())/g.interval()), 0),
+		RetryAfter: g.Delay(now),
+		Reset:      ahead,
+	}
+}
+
+func (g *GCRA) Rate() Rate {
+	return scaledRate(g.rate, g.scale)
+}
+
+func (g *GCRA) SetScale(now time.Time, scale float64) {
+	g.scale = scale
+}
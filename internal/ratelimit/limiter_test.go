@@ -0,0 +1,227 @@
+package ratelimit
+
+import (
+	"hiurachat/internal/clock"
+	"strings"
+	"testing"
+	"time"
+)
+
+// epoch is aligned to a second so fixed windows start on it.
+var epoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// twoPerSecond is the rate every algorithm is checked against: 2 sends per
+// second, both of them allowed back to back.
+var twoPerSecond = Rate{Limit: 2, Window: time.Second, Burst: 2}
+
+// script is when sends are attempted, in milliseconds after epoch.
+var script = []int{0, 0, 0, 250, 500, 750, 1000, 1500, 2000, 2000, 2000, 2250}
+
+var algorithms = []Algorithm{AlgorithmTokenBucket, AlgorithmGCRA, AlgorithmSlidingWindow, AlgorithmFixedWindow}
+
+func at(ms int) time.Time {
+	return epoch.Add(time.Duration(ms) * time.Millisecond)
+}
+
+// admit takes a send at now if the limiter allows one.
+func admit(l Limiter, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.Delay(now) > 0 {
+		return false
+	}
+	l.Take(now)
+	return true
+}
+
+// run attempts a send at every step of steps and returns the outcomes, "+"
+// for admitted and "-" for refused.
+func run(l Limiter, steps []int) string {
+	var b strings.Builder
+	for _, ms := range steps {
+		if admit(l, at(ms)) {
+			b.WriteByte('+')
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	return b.String()
+}
+
+func state(l Limiter, now time.Time) LimiterState {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.State(now)
+}
+
+func TestLimiterAdmissions(t *testing.T) {
+	want := map[Algorithm]string{
+		// One token back every 500ms, so sends keep going out at that pace.
+		AlgorithmTokenBucket: "++--+-+++---",
+		AlgorithmGCRA:        "++--+-+++---",
+		// Nothing until both sends at 0 have left the window at 1000.
+		AlgorithmSlidingWindow: "++----+++---",
+		// The window at 2000 starts with a full count.
+		AlgorithmFixedWindow: "++----++++--",
+	}
+
+	for _, algorithm := range algorithms {
+		t.Run(string(algorithm), func(t *testing.T) {
+			rate := twoPerSecond
+			rate.Algorithm = algorithm
+			if got := run(NewLimiter(rate), script); got != want[algorithm] {
+				t.Errorf("admissions = %s, want %s", got, want[algorithm])
+			}
+		})
+	}
+}
+
+func TestLimiterState(t *testing.T) {
+	tests := []struct {
+		algorithm Algorithm
+		want      LimiterState
+	}{
+		// Half a token left at 2250.
+		{AlgorithmTokenBucket, LimiterState{Remaining: 0, RetryAfter: 250 * time.Millisecond, Reset: 750 * time.Millisecond}},
+		{AlgorithmGCRA, LimiterState{Remaining: 0, RetryAfter: 250 * time.Millisecond, Reset: 750 * time.Millisecond}},
+		// The send at 1500 leaves the window at 2500, the one at 2000 at 3000.
+		{AlgorithmSlidingWindow, LimiterState{Remaining: 0, RetryAfter: 250 * time.Millisecond, Reset: 750 * time.Millisecond}},
+		// The window that began at 2000 ends at 3000.
+		{AlgorithmFixedWindow, LimiterState{Remaining: 0, RetryAfter: 750 * time.Millisecond, Reset: 750 * time.Millisecond}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.algorithm), func(t *testing.T) {
+			rate := twoPerSecond
+			rate.Algorithm = tt.algorithm
+			l := NewLimiter(rate)
+
+			fresh := LimiterState{Remaining: 2}
+			if got := state(l, epoch); got != fresh {
+				t.Errorf("fresh state = %+v, want %+v", got, fresh)
+			}
+
+			run(l, script)
+			if got := state(l, at(2250)); got != tt.want {
+				t.Errorf("state at 2250ms = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiterSetScale(t *testing.T) {
+	for _, algorithm := range algorithms {
+		t.Run(string(algorithm), func(t *testing.T) {
+			rate := twoPerSecond
+			rate.Algorithm = algorithm
+			l := NewLimiter(rate)
+
+			l.Lock()
+			l.SetScale(epoch, 0.5)
+			scaled := l.Rate()
+			l.Unlock()
+
+			want := Rate{Limit: 1, Window: time.Second, Burst: 1, Algorithm: algorithm}
+			if scaled != want {
+				t.Errorf("scaled rate = %+v, want %+v", scaled, want)
+			}
+			// Halved, one send per second gets through.
+			if got := run(l, []int{0, 0, 500, 1000}); got != "+--+" {
+				t.Errorf("scaled admissions = %s, want +--+", got)
+			}
+
+			l.Lock()
+			l.SetScale(at(1000), 1)
+			restored := l.Rate()
+			l.Unlock()
+
+			if restored != rate {
+				t.Errorf("restored rate = %+v, want %+v", restored, rate)
+			}
+		})
+	}
+}
+
+func TestRateValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rate Rate
+		ok   bool
+	}{
+		{"token bucket", Rate{Limit: 15, Window: 30 * time.Second, Burst: 3}, true},
+		{"gcra", Rate{Limit: 1, Window: time.Second, Burst: 1, Algorithm: AlgorithmGCRA}, true},
+		{"sliding window without burst", Rate{Limit: 5, Window: time.Second, Algorithm: AlgorithmSlidingWindow}, true},
+		{"no window", Rate{Limit: 1, Burst: 1}, false},
+		{"no limit", Rate{Window: time.Second, Burst: 1}, false},
+		{"token bucket without burst", Rate{Limit: 1, Window: time.Second}, false},
+		{"fixed window below one send", Rate{Limit: 0.5, Window: time.Second, Algorithm: AlgorithmFixedWindow}, false},
+		{"unknown algorithm", Rate{Limit: 1, Window: time.Second, Burst: 1, Algorithm: "leaky"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rate.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate() = %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRateLimiterFollowsClock(t *testing.T) {
+	fake := clock.NewFake(epoch)
+	rl := NewRateLimiter(Rate{Limit: 3, Window: 30 * time.Second, Algorithm: AlgorithmSlidingWindow})
+	rl.SetClock(fake)
+
+	for i := range 3 {
+		if _, ok := rl.TryAcquire("sendMessage"); !ok {
+			t.Fatalf("send %d refused", i+1)
+		}
+	}
+
+	steps := []struct {
+		advance time.Duration
+		wait    time.Duration
+	}{
+		{0, 30 * time.Second},
+		{29 * time.Second, time.Second},
+		{time.Second, 0},
+	}
+	for _, step := range steps {
+		fake.Advance(step.advance)
+		wait, ok := rl.TryAcquire("sendMessage")
+		if ok != (step.wait == 0) || wait != step.wait {
+			t.Fatalf("at %v: wait = %v, admitted %t; want wait %v", fake.Since(epoch), wait, ok, step.wait)
+		}
+	}
+}
+
+func TestRefusalKeepsTokens(t *testing.T) {
+	fake := clock.NewFake(epoch)
+	rl := NewRateLimiter(Rate{Limit: 3, Window: time.Minute, Burst: 3})
+	rl.SetClock(fake)
+	rl.SetRouteLimit("getId", Rate{Limit: 1, Window: time.Minute, Burst: 1})
+	rl.SetTargetLimit(Rate{Limit: 1, Window: time.Minute, Burst: 1})
+
+	steps := []struct {
+		route, target string
+		ok            bool
+	}{
+		{"getId", "", true},
+		// The route is out of tokens, so global must not pay for this.
+		{"getId", "", false},
+		{"getId", "", false},
+		{"sendMessage", "alice", true},
+		// Same for a target that is out of tokens.
+		{"sendMessage", "alice", false},
+		// One getId and one send to alice leave global one token.
+		{"sendMessage", "bob", true},
+		{"sendMessage", "carol", false},
+	}
+	for i, step := range steps {
+		if _, ok := rl.TryAcquireTarget(step.route, step.target); ok != step.ok {
+			t.Fatalf("step %d (%s to %q): admitted %t, want %t", i+1, step.route, step.target, ok, step.ok)
+		}
+	}
+}
@@ -1,113 +1,233 @@
 package ratelimit
 
 import (
+	"hiurachat/internal/clock"
 	"sync"
 	"time"
 )
 
+// RateLimiter composes up to three limiters per send: the global limiter,
+// the limiter of the message's route if one is configured, and a limiter per
+// target (recipient or channel) if a target rate is set. A send goes out only
+// when every limiter that applies admits it, and then counts against each.
+//
+// Callers never block in the limiter. The connection's writer asks for a
+// token with TryAcquireTarget and, when refused, keeps the message at the
+// head of its lane until the returned delay has passed, so the lanes decide
+// who goes first and waiting senders are served in order.
 type RateLimiter struct {
-	mu            sync.RWMutex
-	globalBucket  *TokenBucket
-	routeBuckets  map[string]*TokenBucket
-	defaultLimit  Rate
-	defaultBurst  int
-	routeLimits   map[string]Rate
-	waitForTokens bool
+	mu             sync.RWMutex
+	globalLimiter  Limiter
+	routeLimiters  map[string]Limiter
+	targetLimiters map[string]Limiter
+	defaultLimit   Rate
+	routeLimits    map[string]Rate
+	targetLimit    *Rate
+	adaptive       *adaptive
+	routeCounters  map[string]*routeCounters
+	clock          clock.Clock
 }
 
+// Rate allows Limit sends per Window, enforced by Algorithm. Burst is how
+// many of them may go out back to back; the window algorithms ignore it,
+// since they let the whole Limit through at once.
 type Rate struct {
-	Limit  float64       // Tokens per second
-	Burst  int           // Maximum burst size
-	Window time.Duration // Time window for rate limiting
+	Limit     float64       `yaml:"limit"`     // Sends per Window
+	Burst     int           `yaml:"burst"`     // Sends allowed back to back (token_bucket, gcra)
+	Window    time.Duration `yaml:"window"`    // Period Limit applies to
+	Algorithm Algorithm     `yaml:"algorithm"` // Empty means token_bucket
 }
 
+// TokenBucket refills Limit tokens per Window, holding at most Burst.
 type TokenBucket struct {
 	mu        sync.Mutex
 	rate      Rate
 	tokens    float64
 	lastTime  time.Time
 	maxTokens float64
+	// scale is the adaptive factor applied to rate; 1 when not adapting.
+	scale float64
 }
 
-func NewRateLimiter(defaultRate Rate, waitForTokens bool) *RateLimiter {
+// NewRateLimiter builds a limiter whose global limit is defaultRate. The
+// rates it is given must pass Validate.
+func NewRateLimiter(defaultRate Rate) *RateLimiter {
 	rl := &RateLimiter{
-		globalBucket:  newTokenBucket(defaultRate),
-		routeBuckets:  make(map[string]*TokenBucket),
-		defaultLimit:  defaultRate,
-		routeLimits:   make(map[string]Rate),
-		waitForTokens: waitForTokens,
+		globalLimiter:  NewLimiter(defaultRate),
+		routeLimiters:  make(map[string]Limiter),
+		targetLimiters: make(map[string]Limiter),
+		defaultLimit:   defaultRate,
+		routeLimits:    make(map[string]Rate),
+		routeCounters:  make(map[string]*routeCounters),
+		clock:          clock.Real,
 	}
 	return rl
 }
 
-func newTokenBucket(rate Rate) *TokenBucket {
+// SetClock makes the limiter read the time from c and wait on its timers.
+// It must be called before the limiter is used.
+func (rl *RateLimiter) SetClock(c clock.Clock) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.clock = c
+}
+
+func NewTokenBucket(rate Rate) *TokenBucket {
 	return &TokenBucket{
 		rate:      rate,
 		tokens:    float64(rate.Burst),
-		lastTime:  time.Now(),
 		maxTokens: float64(rate.Burst),
+		scale:     1,
 	}
 }
 
+func (tb *TokenBucket) Lock()   { tb.mu.Lock() }
+func (tb *TokenBucket) Unlock() { tb.mu.Unlock() }
+
+func (tb *TokenBucket) Delay(now time.Time) time.Duration {
+	tb.update(now)
+	return tb.timeToNext()
+}
+
+func (tb *TokenBucket) Take(now time.Time) {
+	tb.update(now)
+	tb.tokens--
+}
+
+func (tb *TokenBucket) State(now time.Time) LimiterState {
+	tb.update(now)
+	return LimiterState{
+		Remaining:  int(tb.tokens),
+		RetryAfter: tb.timeToNext(),
+		Reset:      time.Duration((tb.maxTokens - tb.tokens) / tb.perSecond() * float64(time.Second)),
+	}
+}
+
+func (tb *TokenBucket) Rate() Rate {
+	return scaledRate(tb.rate, tb.scale)
+}
+
+func (tb *TokenBucket) SetScale(now time.Time, scale float64) {
+	tb.update(now)
+	tb.scale = scale
+	tb.maxTokens = float64(scaledBurst(tb.rate.Burst, scale))
+	tb.tokens = min(tb.tokens, tb.maxTokens)
+}
+
+func (tb *TokenBucket) perSecond() float64 {
+	return tb.rate.Limit * tb.scale / tb.rate.Window.Seconds()
+}
+
 func (tb *TokenBucket) update(now time.Time) {
 	elapsed := now.Sub(tb.lastTime)
-	tokensPerSecond := tb.rate.Limit / tb.rate.Window.Seconds()
-	tb.tokens += elapsed.Seconds() * tokensPerSecond
+	tb.tokens += elapsed.Seconds() * tb.perSecond()
 	if tb.tokens > tb.maxTokens {
 		tb.tokens = tb.maxTokens
 	}
 	tb.lastTime = now
 }
 
-func (tb *TokenBucket) tryAcquire(wait bool) (time.Duration, bool) {
-	tb.mu.Lock()
-	defer tb.mu.Unlock()
-
-	now := time.Now()
-	tb.update(now)
-
+// timeToNext must be called with tb.mu held and after update.
+func (tb *TokenBucket) timeToNext() time.Duration {
 	if tb.tokens >= 1.0 {
-		tb.tokens--
-		return 0, true
+		return 0
 	}
+	return time.Duration((1.0 - tb.tokens) / tb.perSecond() * float64(time.Second))
+}
 
-	tokensPerSecond := tb.rate.Limit / tb.rate.Window.Seconds()
-	timeToNext := time.Duration((1.0 - tb.tokens) / tokensPerSecond * float64(time.Second))
-
-	if !wait {
-		return timeToNext, false
+// reserve admits a send on every limiter or on none of them. The limiters
+// are locked in the order given, which callers keep as global, route, target
+// so two reservations can never deadlock. When any limiter refuses it
+// returns the longest wait among them.
+func reserve(limiters []Limiter, now time.Time) (time.Duration, bool) {
+	for _, l := range limiters {
+		l.Lock()
+	}
+	defer func() {
+		for _, l := range limiters {
+			l.Unlock()
+		}
+	}()
+
+	var wait time.Duration
+	for _, l := range limiters {
+		wait = max(wait, l.Delay(now))
+	}
+	if wait > 0 {
+		return wait, false
 	}
 
-	time.Sleep(timeToNext)
-	tb.tokens = 0
-	return timeToNext, true
+	for _, l := range limiters {
+		l.Take(now)
+	}
+	return 0, true
 }
 
 func (rl *RateLimiter) SetRouteLimit(route string, rate Rate) {
+	limiter := NewLimiter(rate)
+	limiter.SetScale(rl.clock.Now(), rl.factor())
+
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
 	rl.routeLimits[route] = rate
-	rl.routeBuckets[route] = newTokenBucket(rate)
+	rl.routeLimiters[route] = limiter
 }
 
-func (rl *RateLimiter) Wait(route string) time.Duration {
-	bucket := rl.getBucket(route)
-	waitTime, _ := bucket.tryAcquire(true)
-	return waitTime
+// SetTargetLimit gives every target its own limiter with rate, on top of the
+// global and route limiters. Targets get their limiter on first use.
+func (rl *RateLimiter) SetTargetLimit(rate Rate) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.targetLimit = &rate
+	rl.targetLimiters = make(map[string]Limiter)
 }
 
 func (rl *RateLimiter) TryAcquire(route string) (time.Duration, bool) {
-	bucket := rl.getBucket(route)
-	return bucket.tryAcquire(false)
+	return rl.TryAcquireTarget(route, "")
+}
+
+// TryAcquireTarget admits a send on route to target on every limiter that
+// applies, or returns how long to wait without counting it against any.
+// An empty target skips the per-target limiter. A caller that holds the send
+// back reports how that ends with CountWait or CountDenial, since retrying
+// the same send is not a new one.
+func (rl *RateLimiter) TryAcquireTarget(route, target string) (time.Duration, bool) {
+	now := rl.clock.Now()
+	rl.recover(now)
+	wait, ok := reserve(rl.limiters(route, target), now)
+	if ok {
+		rl.recordSend(now)
+	}
+	return wait, ok
 }
 
-func (rl *RateLimiter) getBucket(route string) *TokenBucket {
+func (rl *RateLimiter) limiters(route, target string) []Limiter {
+	factor := rl.factor()
+
 	rl.mu.RLock()
-	defer rl.mu.RUnlock()
+	limiters := []Limiter{rl.globalLimiter}
+	if limiter, exists := rl.routeLimiters[route]; exists {
+		limiters = append(limiters, limiter)
+	}
+	if target == "" || rl.targetLimit == nil {
+		rl.mu.RUnlock()
+		return limiters
+	}
 
-	if bucket, exists := rl.routeBuckets[route]; exists {
-		return bucket
+	limiter, exists := rl.targetLimiters[target]
+	rl.mu.RUnlock()
+
+	if !exists {
+		rl.mu.Lock()
+		if limiter, exists = rl.targetLimiters[target]; !exists {
+			limiter = NewLimiter(*rl.targetLimit)
+			limiter.SetScale(rl.clock.Now(), factor)
+			rl.targetLimiters[target] = limiter
+		}
+		rl.mu.Unlock()
 	}
-	return rl.globalBucket
+	return append(limiters, limiter)
 }
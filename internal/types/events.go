@@ -0,0 +1,154 @@
+package types
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+const (
+	EventIdentity = "identity"
+	EventChat     = "message"
+	EventNotice   = "system"
+	EventJoin     = "join"
+	EventLeave    = "leave"
+	EventUnknown  = "unknown"
+)
+
+// Event is an inbound frame decoded into the type registered for it.
+type Event interface {
+	EventType() string
+}
+
+// Identity answers getId.
+type Identity struct {
+	ConnectionId string `json:"connectionId"`
+	Name         string `json:"name"`
+}
+
+func (Identity) EventType() string { return EventIdentity }
+
+// ChatMessage is a message someone, possibly the bot itself, sent to the
+// room.
+type ChatMessage struct {
+	Message    string `json:"message"`
+	Sender     string `json:"sender"`
+	SenderName string `json:"senderName"`
+}
+
+func (ChatMessage) EventType() string { return EventChat }
+
+// SystemNotice is a message from the server rather than a user.
+type SystemNotice struct {
+	Message string `json:"message"`
+	Level   string `json:"level,omitempty"`
+}
+
+func (SystemNotice) EventType() string { return EventNotice }
+
+// Presence reports a user joining or leaving.
+type Presence struct {
+	Type         string `json:"type"`
+	ConnectionId string `json:"connectionId"`
+	Name         string `json:"name"`
+}
+
+func (p Presence) EventType() string { return p.Type }
+
+// Joined reports whether the user joined rather than left.
+func (p Presence) Joined() bool { return p.Type == EventJoin }
+
+// UnknownEvent is any frame no registered event type claimed.
+type UnknownEvent struct {
+	Response Response
+}
+
+func (UnknownEvent) EventType() string { return EventUnknown }
+
+// EventDecoder turns a raw frame into an Event.
+type EventDecoder func(Response) (Event, error)
+
+type eventEntry struct {
+	typ    string
+	match  func(Response) bool
+	decode EventDecoder
+}
+
+// EventRegistry maps inbound frames to event types. A frame with a "type"
+// field goes to the entry registered for that type; an untyped frame goes to
+// the first entry whose shape matcher accepts it.
+type EventRegistry struct {
+	mu      sync.RWMutex
+	entries []eventEntry
+}
+
+func NewEventRegistry() *EventRegistry {
+	return &EventRegistry{}
+}
+
+// Register adds or replaces the decoder for typ. match may be nil when the
+// server always tags these frames with their type.
+func (r *EventRegistry) Register(typ string, match func(Response) bool, decode EventDecoder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, e := range r.entries {
+		if e.typ == typ {
+			r.entries[i] = eventEntry{typ, match, decode}
+			return
+		}
+	}
+	r.entries = append(r.entries, eventEntry{typ, match, decode})
+}
+
+// Decode returns the event for resp, or an UnknownEvent if nothing claims it
+// or its decoder fails.
+func (r *EventRegistry) Decode(resp Response) Event {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, e := range r.entries {
+		if resp.Type != "" && e.typ != resp.Type {
+			continue
+		}
+		if resp.Type == "" && (e.match == nil || !e.match(resp)) {
+			continue
+		}
+
+		if ev, err := e.decode(resp); err == nil {
+			return ev
+		}
+		break
+	}
+	return UnknownEvent{Response: resp}
+}
+
+// DecodeAs decodes the whole frame, extra fields included, into T. It is the
+// decoder to use for any event whose fields map straight onto the frame.
+func DecodeAs[T Event](resp Response) (Event, error) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var ev T
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// DefaultEvents knows the events the HiuraChat server sends today. New ones
+// can be registered on it without touching this package.
+var DefaultEvents = NewEventRegistry()
+
+func init() {
+	DefaultEvents.Register(EventIdentity, Response.IsIdentity, DecodeAs[Identity])
+	DefaultEvents.Register(EventChat, func(r Response) bool {
+		return r.Sender != "" && r.Message != ""
+	}, DecodeAs[ChatMessage])
+	DefaultEvents.Register(EventNotice, func(r Response) bool {
+		return r.Sender == "" && r.Message != ""
+	}, DecodeAs[SystemNotice])
+	DefaultEvents.Register(EventJoin, nil, DecodeAs[Presence])
+	DefaultEvents.Register(EventLeave, nil, DecodeAs[Presence])
+}
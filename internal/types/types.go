@@ -1,31 +1,122 @@
 package types
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+)
 
+// Message is an outbound action. Data may be any value that marshals to
+// JSON, so new actions need no changes here.
 type Message struct {
-	Action string       `json:"action"`
-	Data   *MessageData `json:"data,omitempty"`
+	Action string `json:"action"`
+	Data   any    `json:"data,omitempty"`
+	// Target names the recipient or channel so sends to it can be rate
+	// limited together. It is not sent to the server.
+	Target string `json:"-"`
 }
 
+// MessageData is the payload of sendMessage.
 type MessageData struct {
 	Message string `json:"message"`
 }
 
+// DecodeData decodes the message's data into v. It works whether Data holds
+// the typed value it was built with or the generic form json.Unmarshal
+// produced on the receiving side.
+func (m Message) DecodeData(v any) error {
+	if m.Data == nil {
+		return fmt.Errorf("%s has no data", m.Action)
+	}
+
+	raw, ok := m.Data.(json.RawMessage)
+	if !ok {
+		var err error
+		if raw, err = json.Marshal(m.Data); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// Response is the envelope of every inbound frame. The fields the bot relies
+// on are decoded directly; anything else the server sends is kept in Extra
+// and written back out by MarshalJSON, so nothing is lost on the way
+// through.
 type Response struct {
+	Type         string `json:"type,omitempty"`
 	ConnectionId string `json:"connectionId,omitempty"`
 	Name         string `json:"name,omitempty"`
 	Message      string `json:"message,omitempty"`
 	Sender       string `json:"sender,omitempty"`
 	SenderName   string `json:"senderName,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// response has Response's fields without its methods, so the JSON methods
+// below can use the default encoding for them.
+type response Response
+
+var envelopeFields = []string{"type", "connectionId", "name", "message", "sender", "senderName"}
+
+func (r *Response) UnmarshalJSON(data []byte) error {
+	var known response
+	if err := json.Unmarshal(data, &known); err != nil {
+		return err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for _, field := range envelopeFields {
+		delete(all, field)
+	}
+	if len(all) == 0 {
+		all = nil
+	}
+
+	*r = Response(known)
+	r.Extra = all
+	return nil
+}
+
+func (r Response) MarshalJSON() ([]byte, error) {
+	known, err := json.Marshal(response(r))
+	if err != nil || len(r.Extra) == 0 {
+		return known, err
+	}
+
+	merged := make(map[string]json.RawMessage, len(r.Extra)+len(envelopeFields))
+	for k, v := range r.Extra {
+		merged[k] = v
+	}
+	if err := json.Unmarshal(known, &merged); err != nil {
+		return nil, err
+	}
+	return json.Marshal(merged)
+}
+
+// Field decodes the extra field name into v and reports whether it was
+// present.
+func (r Response) Field(name string, v any) (bool, error) {
+	raw, ok := r.Extra[name]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// IsIdentity reports whether r answers getId. Typed events such as joins
+// may carry someone else's connectionId, so only untyped frames count.
+func (r Response) IsIdentity() bool {
+	return r.ConnectionId != "" && (r.Type == "" || r.Type == EventIdentity)
 }
 
 type Command struct {
 	Name        string
 	Description string
-	Execute     func(args []string) (string, bool)
-}
-
-type Latency interface {
-	GetLatency() time.Time
-	SetLatency(time.Time)
+	// AdminOnly commands are ignored unless sent by someone in bot.admins.
+	AdminOnly bool
+	Execute   func(args []string) (string, bool)
 }
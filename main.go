@@ -1,27 +1,71 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"hiurachat/internal/bot"
 	"hiurachat/internal/config"
 	"hiurachat/internal/logger"
 )
 
+const (
+	exitOK      = 0
+	exitFailure = 1
+)
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			os.Exit(serve(os.Args[2:]))
+		case "replay":
+			os.Exit(replay(os.Args[2:]))
+		}
+	}
+	os.Exit(run())
+}
+
+func run() int {
 	cfg, err := config.LoadConfig("config.yml")
 
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		log.Printf("Failed to load config: %v", err)
+		return exitFailure
 	}
 
 	l := logger.NewLogger()
 	if l == nil {
-		log.Fatal("Failed to initialize logger")
+		log.Print("Failed to initialize logger")
+		return exitFailure
 	}
 	defer l.Close()
 
-	switch cfg.Logger.Level {
+	configureLogger(l, cfg.Logger.Level, cfg.Logger.UseColors)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	bot, err := bot.New(l, cfg)
+	if err != nil {
+		l.Error("Failed to initialize bot: %v", err)
+		return exitFailure
+	}
+
+	if err := bot.Run(ctx); err != nil {
+		l.Error("Bot stopped with error: %v", err)
+		return exitFailure
+	}
+
+	l.Info("Shutdown complete")
+	return exitOK
+}
+
+func configureLogger(l *logger.Logger, level string, useColors bool) {
+	switch level {
 	case "debug":
 		l.SetLogLevel(logger.DEBUG)
 	case "info":
@@ -31,18 +75,5 @@ func main() {
 	case "error":
 		l.SetLogLevel(logger.ERROR)
 	}
-	l.SetUseColors(cfg.Logger.UseColors)
-
-	bot, err := bot.New(l, cfg)
-	if err != nil {
-		l.Error("Failed to initialize bot: %v", err)
-		return
-	}
-
-	if err := bot.Start(); err != nil {
-		l.Error("Bot failed to start: %v", err)
-		return
-	}
-
-	select {}
+	l.SetUseColors(useColors)
 }
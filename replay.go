@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"hiurachat/internal/bot"
+	"hiurachat/internal/config"
+	"hiurachat/internal/connection"
+	"hiurachat/internal/logger"
+	"hiurachat/internal/types"
+)
+
+// replay feeds a recording made with websocket.record through the bot over
+// an in-memory transport and diffs what the bot sends against what it sent
+// when the recording was made. It exits non-zero when they differ.
+func replay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := fs.Float64("speed", 1, "playback speed: 1 keeps the recorded timing, 10 is ten times faster, 0 skips all delays")
+	cfgPath := fs.String("config", "config.yml", "config file providing the bot settings")
+	settle := fs.Duration("settle", 2*time.Second, "how long to wait for replies after the last inbound frame")
+	level := fs.String("log-level", "warn", "debug, info, warn or error")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: hiurachat replay [flags] <recording.jsonl>")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return exitFailure
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitFailure
+	}
+
+	frames, err := connection.ReadRecording(fs.Arg(0))
+	if err != nil {
+		log.Printf("Failed to read recording: %v", err)
+		return exitFailure
+	}
+
+	cfg, err := config.LoadConfig(*cfgPath)
+	if err != nil {
+		log.Printf("Failed to load config: %v", err)
+		return exitFailure
+	}
+
+	l := logger.NewLogger()
+	if l == nil {
+		log.Print("Failed to initialize logger")
+		return exitFailure
+	}
+	defer l.Close()
+	configureLogger(l, *level, cfg.Logger.UseColors)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	pipe, peer := connection.NewPipe(len(frames) + 1)
+	b, err := bot.NewWithTransport(l, cfg, pipe)
+	if err != nil {
+		l.Error("Failed to initialize bot: %v", err)
+		return exitFailure
+	}
+
+	var (
+		mu       sync.Mutex
+		replayed []types.Message
+		wg       sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case msg := <-peer.Outbound():
+				mu.Lock()
+				replayed = append(replayed, msg)
+				mu.Unlock()
+			case <-peer.Done():
+				return
+			}
+		}
+	}()
+
+	if err := b.Start(); err != nil {
+		l.Error("Failed to start bot: %v", err)
+		return exitFailure
+	}
+
+	playFrames(ctx, peer, frames, *speed)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(*settle):
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Bot.ShutdownTimeout)
+	defer cancel()
+	if err := b.Shutdown(shutdownCtx); err != nil {
+		l.Error("Shutdown failed: %v", err)
+	}
+	wg.Wait()
+
+	// The collector may have stopped with messages still buffered.
+	for len(peer.Outbound()) > 0 {
+		replayed = append(replayed, <-peer.Outbound())
+	}
+
+	var recorded []types.Message
+	for _, f := range frames {
+		if f.Direction == connection.FrameOutbound && f.Message != nil {
+			recorded = append(recorded, *f.Message)
+		}
+	}
+
+	if !printDiff(os.Stdout, recorded, replayed) {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// playFrames delivers the inbound frames, spacing them as they were recorded
+// divided by speed.
+func playFrames(ctx context.Context, peer *connection.PipePeer, frames []connection.Frame, speed float64) {
+	if len(frames) == 0 {
+		return
+	}
+
+	origin := frames[0].At
+	start := time.Now()
+
+	for _, f := range frames {
+		if f.Direction != connection.FrameInbound || f.Response == nil {
+			continue
+		}
+
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(f.At.Sub(origin)) / speed))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(due)):
+			}
+		}
+
+		if err := peer.Deliver(ctx, *f.Response); err != nil {
+			return
+		}
+	}
+}
+
+// printDiff writes a line diff of the recorded and replayed messages and
+// reports whether they matched.
+func printDiff(w io.Writer, recorded, replayed []types.Message) bool {
+	a := encodeAll(recorded)
+	b := encodeAll(replayed)
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	same := lcs[0][0] == len(a) && len(a) == len(b)
+	if same {
+		fmt.Fprintf(w, "Replay matched all %d recorded outbound messages\n", len(a))
+		return true
+	}
+
+	fmt.Fprintf(w, "Replay differs (- recorded, + replayed):\n")
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(w, "  %s\n", a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(w, "- %s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(w, "+ %s\n", b[j])
+			j++
+		}
+	}
+	return false
+}
+
+// encodeAll renders each message as canonical JSON, so a recorded data
+// object, decoded as a map, compares equal to the struct that produced it.
+func encodeAll(msgs []types.Message) []string {
+	out := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		var generic any
+		data, err := json.Marshal(m)
+		if err == nil {
+			err = json.Unmarshal(data, &generic)
+		}
+		if err == nil {
+			data, err = json.Marshal(generic)
+		}
+		if err != nil {
+			data = []byte(fmt.Sprintf("%+v", m))
+		}
+		out = append(out, string(data))
+	}
+	return out
+}
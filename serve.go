@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"hiurachat/internal/logger"
+	"hiurachat/internal/mockserver"
+)
+
+// serve runs a local mock of the chat server so commands can be tried
+// without touching production.
+func serve(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "address to listen on")
+	level := fs.String("log-level", "info", "debug, info, warn or error")
+	var opts mockserver.Options
+	fs.StringVar(&opts.CertFile, "cert", "", "TLS certificate file; serves wss:// when set with -key")
+	fs.StringVar(&opts.KeyFile, "key", "", "TLS private key file")
+	fs.StringVar(&opts.Token, "token", "", "reject handshakes without this bearer token")
+	faults := &opts.Faults
+	fs.Float64Var(&faults.DropRate, "drop-rate", 0, "chance of dropping a connection after each inbound frame")
+	fs.IntVar(&faults.DropAfter, "drop-after", 0, "drop every connection after this many inbound frames")
+	fs.DurationVar(&faults.Delay, "delay", 0, "delay added before every outbound frame")
+	fs.IntVar(&faults.Throttle, "throttle", 0, "inbound frames allowed per throttle window before closing with 1013")
+	fs.DurationVar(&faults.ThrottleWindow, "throttle-window", 0, "window for -throttle")
+
+	if err := fs.Parse(args); err != nil {
+		return exitFailure
+	}
+
+	l := logger.NewLogger()
+	if l == nil {
+		log.Print("Failed to initialize logger")
+		return exitFailure
+	}
+	defer l.Close()
+	configureLogger(l, *level, true)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := mockserver.New(l, opts)
+	if err := srv.ListenAndServe(ctx, *addr); err != nil {
+		l.Error("Mock server failed: %v", err)
+		return exitFailure
+	}
+	return exitOK
+}